@@ -0,0 +1,225 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/asiekierka/vgmswan/v2/converter/vgm"
+)
+
+const (
+	vgmCommandAY8910 = 0xA0
+	// register numbers
+	ayRegNoisePeriod    = 0x06
+	ayRegMixer          = 0x07
+	ayRegAmplitude      = 0x08
+	ayRegEnvelopePeriod = 0x0B
+	ayRegEnvelopeShape  = 0x0D
+	// amplitude register bit selecting the envelope
+	ayAmplitudeEnvelope = 0x10
+	// envelope shape bits
+	ayShapeHold      = 0x01
+	ayShapeAlternate = 0x02
+	ayShapeAttack    = 0x04
+	ayShapeContinue  = 0x08
+)
+
+// AYEnvelopeRate is the rate at which AY-3-8910 hardware envelopes are
+// sampled into volume writes, in Hz.
+var AYEnvelopeRate = 75.0
+
+// ay8910Translator maps the AY-3-8910's three tone channels onto WonderSwan
+// channels 1-3 with square waves, and its noise generator onto channel 4.
+type ay8910Translator struct {
+	translationReport
+	clock float64
+	// YM2149-style chips have 32 envelope steps instead of 16
+	envelopeSteps int
+	regs          [16]uint8
+	// VGM samples since the envelope was restarted, and since the last
+	// envelope tick
+	envelopeTime float64
+	tickPhase    float64
+}
+
+func newAY8910Translator(header *vgm.VGMHeader) *ay8910Translator {
+	t := ay8910Translator{
+		clock:         float64(header.ClockAY8910 & 0x3FFFFFFF),
+		envelopeSteps: 16,
+	}
+	if header.TypeAY8910 >= vgm.VGM_AY8910_TYPE_YM2149 {
+		t.envelopeSteps = 32
+	}
+	// all channels start disabled in the mixer
+	t.regs[ayRegMixer] = 0x3F
+	return &t
+}
+
+func (t *ay8910Translator) write(reg uint8, value uint8) {
+	if reg >= 16 {
+		return
+	}
+	t.regs[reg] = value
+	switch {
+	case reg == ayRegEnvelopeShape:
+		t.envelopeTime = 0
+	case reg >= ayRegAmplitude && reg < ayRegAmplitude+3:
+		if (t.regs[ayRegMixer] & (0x09 << (reg - ayRegAmplitude))) == 0x09<<(reg-ayRegAmplitude) {
+			// with tone and noise disabled, volume writes play samples
+			t.drop("volume writes to channels without tone or noise")
+		}
+	}
+}
+
+func (t *ay8910Translator) command(cmd uint8, r io.Reader) (bool, error) {
+	if cmd != vgmCommandAY8910 {
+		return false, nil
+	}
+	var reg, value uint8
+	if err := binary.Read(r, binary.LittleEndian, &reg); err != nil {
+		return true, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+		return true, err
+	}
+	// only the first chip is translated
+	if (reg & 0x80) == 0 {
+		t.write(reg, value)
+	} else {
+		t.drop("second chip")
+	}
+	return true, nil
+}
+
+// envelopeStepRate returns the amount of envelope steps per second.
+func (t *ay8910Translator) envelopeStepRate() float64 {
+	period := float64(uint16(t.regs[ayRegEnvelopePeriod]) | uint16(t.regs[ayRegEnvelopePeriod+1])<<8)
+	if period == 0 {
+		period = 1
+	}
+	// a 16-step cycle lasts 256 clocks per period unit
+	return t.clock / (256 * period) * float64(t.envelopeSteps)
+}
+
+// envelope returns the current envelope level, and whether it will change.
+func (t *ay8910Translator) envelope() (int, bool) {
+	n := t.envelopeSteps
+	steps := int(t.envelopeTime * t.envelopeStepRate() / vgm.VGM_SAMPLES_PER_SECOND)
+	cycle, pos := steps/n, steps%n
+	shape := t.regs[ayRegEnvelopeShape]
+	up := (shape & ayShapeAttack) != 0
+	if cycle > 0 {
+		if (shape & ayShapeContinue) == 0 {
+			return 0, false
+		}
+		if (shape & ayShapeHold) != 0 {
+			// hold the level the first cycle ended on, flipped if alternating
+			if up != ((shape & ayShapeAlternate) != 0) {
+				return n - 1, false
+			}
+			return 0, false
+		}
+		if (shape&ayShapeAlternate) != 0 && (cycle&1) != 0 {
+			up = !up
+		}
+	}
+	if up {
+		return pos, true
+	}
+	return n - 1 - pos, true
+}
+
+// usesEnvelope returns true if any channel is playing the envelope.
+func (t *ay8910Translator) usesEnvelope() bool {
+	for ch := 0; ch < 3; ch++ {
+		if (t.regs[ayRegAmplitude+ch] & ayAmplitudeEnvelope) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *ay8910Translator) untilTick() uint32 {
+	if _, changing := t.envelope(); !changing || !t.usesEnvelope() {
+		return 0
+	}
+	tickSamples := vgm.VGM_SAMPLES_PER_SECOND / AYEnvelopeRate
+	return uint32(math.Max(1, math.Ceil(tickSamples-t.tickPhase)))
+}
+
+func (t *ay8910Translator) advance(samples uint32) {
+	tickSamples := vgm.VGM_SAMPLES_PER_SECOND / AYEnvelopeRate
+	t.envelopeTime += float64(samples)
+	t.tickPhase = math.Mod(t.tickPhase+float64(samples), tickSamples)
+}
+
+// amplitude returns a channel's amplitude; levels are 3dB apart, or 1.5dB
+// for 32-step envelopes.
+func (t *ay8910Translator) amplitude(ch int) float64 {
+	value := t.regs[ayRegAmplitude+ch]
+	level, steps := int(value&0x0F), 16
+	if (value & ayAmplitudeEnvelope) != 0 {
+		level, _ = t.envelope()
+		steps = t.envelopeSteps
+	}
+	if level == 0 {
+		return 0
+	}
+	return math.Pow(10, -float64(steps-1-level)*(48.0/float64(steps))/20)
+}
+
+func (t *ay8910Translator) update(ws *wsShadow) {
+	var square [wsWaveLength]uint8
+	for i := 0; i < wsWaveLength/2; i++ {
+		square[i] = 0x0F
+	}
+	mixer := t.regs[ayRegMixer]
+	noise := 0.0
+	for ch := 0; ch < 3; ch++ {
+		period := float64(uint16(t.regs[ch*2]) | uint16(t.regs[ch*2+1]&0x0F)<<8)
+		if period == 0 {
+			period = 1
+		}
+		amplitude := t.amplitude(ch)
+		ws.setWave(ch, &square)
+		ws.setFrequency(ch, t.clock/(16*period))
+		if (mixer & (0x01 << ch)) == 0 {
+			ws.setVolume(ch, amplitude, amplitude)
+		} else {
+			ws.setVolume(ch, 0, 0)
+		}
+		// the noise generator is heard at the loudest channel mixing it in
+		if (mixer&(0x08<<ch)) == 0 && amplitude > noise {
+			noise = amplitude
+		}
+	}
+	noisePeriod := float64(t.regs[ayRegNoisePeriod] & 0x1F)
+	if noisePeriod == 0 {
+		noisePeriod = 1
+	}
+	ws.setRate(3, t.clock/(16*noisePeriod))
+	ws.setVolume(3, noise, noise)
+	ws.ports[portNoiseCtrl] = 0x10
+	ws.ports[portChCtrl] = 0x0F | chCtrlNoise
+}
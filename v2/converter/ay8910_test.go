@@ -0,0 +1,188 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/asiekierka/vgmswan/v2/converter/vgm"
+)
+
+// ayWrites returns VGM AY-3-8910 register writes of register, value pairs.
+func ayWrites(writes ...uint8) []byte {
+	result := []byte{}
+	for i := 0; i+1 < len(writes); i += 2 {
+		result = append(result, vgmCommandAY8910, writes[i], writes[i+1])
+	}
+	return result
+}
+
+func TestAY8910Translator(t *testing.T) {
+	// channel A at period 0x100
+	tone := ayWrites(0x00, 0x00, 0x01, 0x01)
+	tests := []struct {
+		name        string
+		commands    []byte
+		want        map[uint8]uint8
+		wantDropped map[string]int
+	}{
+		{
+			"tone",
+			concat(tone, ayWrites(ayRegMixer, 0x3E, ayRegAmplitude, 0x0F)),
+			map[uint8]uint8{portFreqCh1: 0x24, portFreqCh1 + 1: 0x07, portVolCh1: 0xFF, portVolCh1 + 3: 0x00, portChCtrl: 0x8F},
+			nil,
+		},
+		{
+			"amplitude",
+			concat(tone, ayWrites(ayRegMixer, 0x3E, ayRegAmplitude, 0x0D)),
+			map[uint8]uint8{portVolCh1: 0x88},
+			nil,
+		},
+		{
+			"silent amplitude",
+			concat(tone, ayWrites(ayRegMixer, 0x3E, ayRegAmplitude, 0x00)),
+			map[uint8]uint8{portVolCh1: 0x00},
+			nil,
+		},
+		{
+			"tone disabled in the mixer",
+			concat(tone, ayWrites(ayRegMixer, 0x3F, ayRegAmplitude, 0x0F)),
+			map[uint8]uint8{portVolCh1: 0x00},
+			map[string]int{"volume writes to channels without tone or noise": 1},
+		},
+		{
+			"noise",
+			ayWrites(ayRegMixer, 0x37, ayRegAmplitude, 0x0F, ayRegNoisePeriod, 0x10),
+			map[uint8]uint8{portFreqCh1 + 6: 0x49, portFreqCh1 + 7: 0x06, portVolCh1: 0x00, portVolCh1 + 3: 0xFF, portNoiseCtrl: 0x10},
+			nil,
+		},
+		{
+			"noise at the loudest channel",
+			ayWrites(ayRegMixer, 0x17, ayRegAmplitude, 0x0D, ayRegAmplitude+2, 0x0F),
+			map[uint8]uint8{portVolCh1 + 3: 0xFF},
+			nil,
+		},
+		{
+			"envelope",
+			concat(tone, ayWrites(ayRegMixer, 0x3E, ayRegEnvelopeShape, 0x00, ayRegAmplitude, ayAmplitudeEnvelope)),
+			map[uint8]uint8{portVolCh1: 0xFF},
+			nil,
+		},
+		{
+			"unknown register",
+			ayWrites(0x10, 0xFF),
+			nil,
+			nil,
+		},
+		{
+			"second chip",
+			ayWrites(0x80|ayRegMixer, 0x3E, 0x80|ayRegAmplitude, 0x0F),
+			map[uint8]uint8{portVolCh1: 0x00},
+			map[string]int{"second chip": 2},
+		},
+	}
+	for _, tt := range tests {
+		translator := newAY8910Translator(&vgm.VGMHeader{ClockAY8910: 1789772})
+		ws := runTranslator(t, translator, tt.commands)
+		checkPorts(t, tt.name, ws, tt.want)
+		checkDropped(t, tt.name, translator, tt.wantDropped)
+	}
+}
+
+func TestAY8910Envelope(t *testing.T) {
+	tests := []struct {
+		chipType     uint8
+		shape        uint8
+		steps        float64
+		want         int
+		wantChanging bool
+	}{
+		{0, 0x00, 0, 15, true},
+		{0, 0x00, 5, 10, true},
+		{0, 0x00, 16, 0, false},
+		{0, 0x04, 3, 3, true},
+		{0, 0x04, 16, 0, false},
+		// repeating
+		{0, 0x08, 16, 15, true},
+		{0, 0x08, 17, 14, true},
+		{0, 0x0C, 21, 5, true},
+		// alternating
+		{0, 0x0A, 20, 4, true},
+		{0, 0x0E, 18, 13, true},
+		// holding
+		{0, 0x09, 20, 0, false},
+		{0, 0x0B, 20, 15, false},
+		{0, 0x0D, 20, 15, false},
+		{0, 0x0F, 20, 0, false},
+		// YM2149 envelopes have 32 steps
+		{vgm.VGM_AY8910_TYPE_YM2149, 0x00, 0, 31, true},
+		{vgm.VGM_AY8910_TYPE_YM2149, 0x0D, 40, 31, false},
+	}
+	for _, tt := range tests {
+		// one envelope step per VGM sample
+		translator := newAY8910Translator(&vgm.VGMHeader{ClockAY8910: vgm.VGM_SAMPLES_PER_SECOND * 16, TypeAY8910: tt.chipType})
+		translator.write(ayRegEnvelopePeriod, 0x01)
+		translator.write(ayRegEnvelopeShape, tt.shape)
+		translator.advance(uint32(tt.steps))
+		if got, changing := translator.envelope(); got != tt.want || changing != tt.wantChanging {
+			t.Errorf("type %02X, shape %X, %v steps: got %d, %v, want %d, %v", tt.chipType, tt.shape, tt.steps, got, changing, tt.want, tt.wantChanging)
+		}
+	}
+}
+
+func TestAY8910TranslatorTimed(t *testing.T) {
+	defer func(v float64) { AYEnvelopeRate = v }(AYEnvelopeRate)
+	AYEnvelopeRate = 75
+
+	translator := newAY8910Translator(&vgm.VGMHeader{ClockAY8910: vgm.VGM_SAMPLES_PER_SECOND * 16})
+	translator.write(ayRegEnvelopePeriod, 0x01)
+	translator.write(ayRegEnvelopeShape, 0x08)
+	if tick := translator.untilTick(); tick != 0 {
+		t.Errorf("unused envelope: next tick in %d samples, want 0", tick)
+	}
+	translator.write(ayRegAmplitude, ayAmplitudeEnvelope)
+	if tick := translator.untilTick(); tick != 588 {
+		t.Errorf("next tick in %d samples, want 588", tick)
+	}
+	translator.advance(100)
+	if tick := translator.untilTick(); tick != 488 {
+		t.Errorf("after 100 samples: next tick in %d samples, want 488", tick)
+	}
+	// restarting the envelope does not move the ticks
+	translator.write(ayRegEnvelopeShape, 0x00)
+	if tick := translator.untilTick(); tick != 488 {
+		t.Errorf("after a restart: next tick in %d samples, want 488", tick)
+	}
+	translator.advance(488)
+	if tick := translator.untilTick(); tick != 0 {
+		t.Errorf("finished envelope: next tick in %d samples, want 0", tick)
+	}
+}
+
+func TestAY8910TranslatorTruncated(t *testing.T) {
+	translator := newAY8910Translator(&vgm.VGMHeader{ClockAY8910: 1789772})
+	for _, data := range [][]byte{nil, {ayRegMixer}} {
+		if ok, err := translator.command(vgmCommandAY8910, bytes.NewReader(data)); !ok || err == nil {
+			t.Errorf("operands % X: got %v, %v, want an error", data, ok, err)
+		}
+	}
+}
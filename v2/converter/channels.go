@@ -0,0 +1,132 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+// Sound port offsets, relative to port 0x80.
+const (
+	portFreqCh1     = 0x00
+	portVolCh1      = 0x08
+	portSweepValue  = 0x0C
+	portSweepTime   = 0x0D
+	portNoiseCtrl   = 0x0E
+	portWaveBase    = 0x0F
+	portChCtrl      = 0x10
+	portVoiceVolume = 0x14
+)
+
+// Channel control (port 0x90) mode bits.
+const (
+	chCtrlVoice = 0x20
+	chCtrlSweep = 0x40
+	chCtrlNoise = 0x80
+)
+
+// chCtrlBits returns the channel control bits belonging to a channel mask.
+func chCtrlBits(channels uint8) uint8 {
+	result := channels & 0x0F
+	if (channels & 0x02) != 0 {
+		result |= chCtrlVoice
+	}
+	if (channels & 0x04) != 0 {
+		result |= chCtrlSweep
+	}
+	if (channels & 0x08) != 0 {
+		result |= chCtrlNoise
+	}
+	return result
+}
+
+// portChannels returns the channel mask a sound port belongs to. The channel
+// control port is shared by all channels and returns zero.
+func portChannels(addr uint8) uint8 {
+	switch {
+	case addr < portVolCh1:
+		return 1 << (addr >> 1)
+	case addr < portSweepValue:
+		return 1 << (addr - portVolCh1)
+	case addr == portSweepValue || addr == portSweepTime:
+		return 0x04
+	case addr == portNoiseCtrl:
+		return 0x08
+	case addr == portVoiceVolume:
+		return 0x02
+	default:
+		return 0
+	}
+}
+
+// portMode returns the channel control mode bit a port's setting is used
+// in, or zero for ports used in every mode.
+func portMode(addr uint8) uint8 {
+	switch addr {
+	case portSweepValue, portSweepTime:
+		return chCtrlSweep
+	case portNoiseCtrl:
+		return chCtrlNoise
+	case portVoiceVolume:
+		return chCtrlVoice
+	default:
+		return 0
+	}
+}
+
+// commandChannels returns the channel mask used by a command. Channel
+// control writes are not counted, as the engine masks them to the channels
+// reserved by a sound effect.
+func commandChannels(cmdRaw interface{}) uint8 {
+	result := uint8(0)
+	switch cmd := cmdRaw.(type) {
+	case *CommandWritePort:
+		for i := range cmd.Data {
+			result |= portChannels(cmd.Address + uint8(i))
+		}
+	case *CommandWriteMemory:
+		for i := range cmd.Data {
+			result |= 1 << (((cmd.Address + uint16(i)) >> 4) & 0x03)
+		}
+	case *CommandPlaySample:
+		result |= 0x02
+	}
+	return result
+}
+
+// songChannels returns the channel mask used by a song.
+func songChannels(song *Song) uint8 {
+	result := uint8(0)
+	for _, frame := range song.Commands {
+		for _, cmd := range frame.Commands {
+			result |= commandChannels(cmd)
+		}
+	}
+	return result
+}
+
+// parseChannelList parses a list of channel numbers, such as "124".
+func parseChannelList(value string) (uint8, bool) {
+	result := uint8(0)
+	for _, c := range value {
+		if c < '1' || c > '4' {
+			return 0, false
+		}
+		result |= 1 << (c - '1')
+	}
+	return result, true
+}
@@ -0,0 +1,331 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/asiekierka/vgmswan/v2/converter/vgm"
+)
+
+const (
+	vgmCommandDMG = 0xB3
+	// register offsets, relative to 0xFF10
+	dmgRegSweep     = 0x00
+	dmgRegWaveDAC   = 0x0A
+	dmgRegWaveLevel = 0x0C
+	dmgRegNoise     = 0x12
+	dmgRegMaster    = 0x14
+	dmgRegPan       = 0x15
+	dmgRegPower     = 0x16
+	dmgRegWaveRAM   = 0x20
+	// the frame sequencer steps at 512Hz
+	dmgSequencerRate = 512
+)
+
+// dmgChannel is the state of one Game Boy APU channel.
+type dmgChannel struct {
+	// registers NRx0 .. NRx4
+	regs    [5]uint8
+	enabled bool
+	length  int
+	// envelope volume and 64Hz ticks until its next step
+	volume        uint8
+	envelopeTimer uint8
+	// frequency, changed by the sweep
+	frequency  uint16
+	sweepTimer uint8
+}
+
+func (c *dmgChannel) dacEnabled() bool {
+	return (c.regs[2] & 0xF8) != 0
+}
+
+// dmgTranslator maps the Game Boy APU's two pulse channels, wave channel and
+// noise channel onto WonderSwan channels 1-4, simulating length counters,
+// envelopes and the frequency sweep.
+type dmgTranslator struct {
+	translationReport
+	clock    float64
+	channels [4]dmgChannel
+	master   uint8
+	pan      uint8
+	power    bool
+	waveRAM  [16]uint8
+	// frame sequencer step and VGM samples since it was last stepped
+	step  uint8
+	phase float64
+}
+
+func newDMGTranslator(header *vgm.VGMHeader) *dmgTranslator {
+	// the APU is left powered on by the boot ROM
+	return &dmgTranslator{
+		clock:  float64(header.ClockDMG & 0x3FFFFFFF),
+		master: 0x77,
+		pan:    0xF3,
+		power:  true,
+	}
+}
+
+func (t *dmgTranslator) write(reg uint8, value uint8) {
+	if reg >= dmgRegWaveRAM && reg < dmgRegWaveRAM+uint8(len(t.waveRAM)) {
+		t.waveRAM[reg-dmgRegWaveRAM] = value
+		return
+	}
+	switch reg {
+	case dmgRegMaster:
+		t.master = value
+		return
+	case dmgRegPan:
+		t.pan = value
+		return
+	case dmgRegPower:
+		t.power = (value & 0x80) != 0
+		return
+	}
+	if reg >= dmgRegMaster {
+		t.drop("writes to unknown registers")
+		return
+	}
+	ch := &t.channels[reg/5]
+	ch.regs[reg%5] = value
+	switch reg % 5 {
+	case 1:
+		if reg/5 == 2 {
+			ch.length = 256 - int(value)
+		} else {
+			ch.length = 64 - int(value&0x3F)
+		}
+	case 2:
+		if reg/5 != 2 && !ch.dacEnabled() {
+			ch.enabled = false
+		}
+	case 3, 4:
+		ch.frequency = uint16(ch.regs[3]) | uint16(ch.regs[4]&0x07)<<8
+		if reg%5 == 4 && (value&0x80) != 0 {
+			t.trigger(reg / 5)
+		}
+	}
+	if reg == dmgRegWaveDAC && (value&0x80) == 0 {
+		ch.enabled = false
+	}
+}
+
+func (t *dmgTranslator) trigger(index uint8) {
+	ch := &t.channels[index]
+	if index == 2 {
+		ch.enabled = (ch.regs[0] & 0x80) != 0
+		if ch.length == 0 {
+			ch.length = 256
+		}
+		return
+	}
+	ch.enabled = ch.dacEnabled()
+	if ch.length == 0 {
+		ch.length = 64
+	}
+	ch.volume = ch.regs[2] >> 4
+	ch.envelopeTimer = ch.regs[2] & 0x07
+	if index == 0 {
+		ch.sweepTimer = (ch.regs[0] >> 4) & 0x07
+		if (ch.regs[0] & 0x07) != 0 {
+			t.sweepFrequency()
+		}
+	}
+}
+
+// sweepFrequency returns the next swept frequency of channel 1, disabling it
+// on overflow.
+func (t *dmgTranslator) sweepFrequency() uint16 {
+	ch := &t.channels[0]
+	delta := ch.frequency >> (ch.regs[0] & 0x07)
+	if (ch.regs[0] & 0x08) != 0 {
+		return ch.frequency - delta
+	}
+	if ch.frequency+delta > 2047 {
+		ch.enabled = false
+	}
+	return ch.frequency + delta
+}
+
+// sequence performs one step of the frame sequencer.
+func (t *dmgTranslator) sequence() {
+	if (t.step & 0x01) == 0 {
+		// length counters
+		for i := range t.channels {
+			ch := &t.channels[i]
+			if (ch.regs[4]&0x40) != 0 && ch.length > 0 {
+				ch.length--
+				if ch.length == 0 {
+					ch.enabled = false
+				}
+			}
+		}
+	}
+	if t.step == 2 || t.step == 6 {
+		ch := &t.channels[0]
+		period := (ch.regs[0] >> 4) & 0x07
+		if ch.sweepTimer > 0 {
+			ch.sweepTimer--
+		}
+		if ch.sweepTimer == 0 && period > 0 {
+			ch.sweepTimer = period
+			if ch.enabled && (ch.regs[0]&0x07) != 0 {
+				frequency := t.sweepFrequency()
+				if ch.enabled {
+					ch.frequency = frequency
+					t.sweepFrequency()
+				}
+			}
+		}
+	}
+	if t.step == 7 {
+		for i := range t.channels {
+			ch := &t.channels[i]
+			period := ch.regs[2] & 0x07
+			if i == 2 || period == 0 {
+				continue
+			}
+			if ch.envelopeTimer > 0 {
+				ch.envelopeTimer--
+			}
+			if ch.envelopeTimer == 0 {
+				ch.envelopeTimer = period
+				if (ch.regs[2]&0x08) != 0 && ch.volume < 15 {
+					ch.volume++
+				} else if (ch.regs[2]&0x08) == 0 && ch.volume > 0 {
+					ch.volume--
+				}
+			}
+		}
+	}
+	t.step = (t.step + 1) & 0x07
+}
+
+func (t *dmgTranslator) command(cmd uint8, r io.Reader) (bool, error) {
+	if cmd != vgmCommandDMG {
+		return false, nil
+	}
+	var reg, value uint8
+	if err := binary.Read(r, binary.LittleEndian, &reg); err != nil {
+		return true, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+		return true, err
+	}
+	// only the first chip is translated
+	if (reg & 0x80) == 0 {
+		t.write(reg, value)
+	} else {
+		t.drop("second chip")
+	}
+	return true, nil
+}
+
+// sequencerSamples is the amount of VGM samples between frame sequencer
+// steps.
+const sequencerSamples = float64(vgm.VGM_SAMPLES_PER_SECOND) / dmgSequencerRate
+
+// maxSequencerSteps bounds the search for the next state change; all
+// timers expire within a second.
+const maxSequencerSteps = dmgSequencerRate + 8
+
+func (t *dmgTranslator) untilTick() uint32 {
+	var current, next wsShadow
+	t.update(&current)
+	sim := *t
+	for i := 1; i <= maxSequencerSteps; i++ {
+		sim.sequence()
+		sim.update(&next)
+		if next.ports != current.ports {
+			return uint32(math.Max(1, math.Ceil(float64(i)*sequencerSamples-t.phase)))
+		}
+	}
+	return 0
+}
+
+func (t *dmgTranslator) advance(samples uint32) {
+	t.phase += float64(samples)
+	for t.phase >= sequencerSamples {
+		t.phase -= sequencerSamples
+		t.sequence()
+	}
+}
+
+// dmgDuties holds the amount of high samples in a 32-sample wavetable for
+// each pulse duty cycle.
+var dmgDuties = [4]int{4, 8, 16, 24}
+
+func (t *dmgTranslator) update(ws *wsShadow) {
+	masterLeft := float64((t.master>>4)&0x07+1) / 8
+	masterRight := float64(t.master&0x07+1) / 8
+	for i := range t.channels {
+		ch := &t.channels[i]
+		period := 2048 - float64(ch.frequency)
+		amplitude := float64(ch.volume) / 15
+		switch i {
+		case 0, 1:
+			var pulse [wsWaveLength]uint8
+			for j := 0; j < dmgDuties[ch.regs[1]>>6]; j++ {
+				pulse[j] = 0x0F
+			}
+			ws.setWave(i, &pulse)
+			ws.setFrequency(i, t.clock/(32*period))
+		case 2:
+			var wave [wsWaveLength]uint8
+			for j, v := range t.waveRAM {
+				wave[j*2] = v >> 4
+				wave[j*2+1] = v & 0x0F
+			}
+			ws.setWave(i, &wave)
+			ws.setFrequency(i, t.clock/(64*period))
+			amplitude = 0
+			if level := (ch.regs[dmgRegWaveLevel%5] >> 5) & 0x03; level > 0 {
+				amplitude = 1 / float64(int(1)<<(level-1))
+			}
+		case 3:
+			// the noise shift register steps at clock / (16 * divisor * 2^shift),
+			// where a divisor code of 0 means 0.5
+			poly := ch.regs[dmgRegNoise%5]
+			divisor := math.Max(0.5, float64(poly&0x07))
+			ws.setRate(i, t.clock/(16*divisor*float64(int(1)<<(poly>>4))))
+			ws.ports[portNoiseCtrl] = 0x10
+			if (poly & 0x08) != 0 {
+				// the 7-bit mode is approximated by a shorter tap
+				ws.ports[portNoiseCtrl] |= 0x01
+			}
+		}
+		if !t.power || !ch.enabled {
+			amplitude = 0
+		}
+		left, right := 0.0, 0.0
+		if (t.pan & (0x10 << i)) != 0 {
+			left = amplitude * masterLeft
+		}
+		if (t.pan & (0x01 << i)) != 0 {
+			right = amplitude * masterRight
+		}
+		ws.setVolume(i, left, right)
+	}
+	ws.ports[portChCtrl] = 0x0F | chCtrlNoise
+}
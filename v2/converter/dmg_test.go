@@ -0,0 +1,189 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/asiekierka/vgmswan/v2/converter/vgm"
+)
+
+// dmgWrites returns VGM Game Boy register writes of register, value pairs.
+func dmgWrites(writes ...uint8) []byte {
+	result := []byte{}
+	for i := 0; i+1 < len(writes); i += 2 {
+		result = append(result, vgmCommandDMG, writes[i], writes[i+1])
+	}
+	return result
+}
+
+func TestDMGTranslator(t *testing.T) {
+	// pulse channel 1 at 50% duty and full volume, period 256: 512 Hz
+	pulse := dmgWrites(0x01, 0x80, 0x02, 0xF0, 0x03, 0x00, 0x04, 0x87)
+	tests := []struct {
+		name        string
+		commands    []byte
+		want        map[uint8]uint8
+		wantWave    map[int]uint8
+		wantDropped map[string]int
+	}{
+		{
+			"pulse",
+			pulse,
+			map[uint8]uint8{portFreqCh1: 0x45, portFreqCh1 + 1: 0x07, portVolCh1: 0xFF, portChCtrl: 0x8F},
+			map[int]uint8{0x00: 0xFF, 0x07: 0xFF, 0x08: 0x00},
+			nil,
+		},
+		{
+			"12.5% duty",
+			concat(pulse, dmgWrites(0x01, 0x00)),
+			nil,
+			map[int]uint8{0x00: 0xFF, 0x01: 0xFF, 0x02: 0x00},
+			nil,
+		},
+		{
+			"DAC off",
+			dmgWrites(0x02, 0x00, 0x04, 0x87),
+			map[uint8]uint8{portVolCh1: 0x00},
+			nil,
+			nil,
+		},
+		{
+			"untriggered channel",
+			dmgWrites(0x02, 0xF0),
+			map[uint8]uint8{portVolCh1: 0x00},
+			nil,
+			nil,
+		},
+		{
+			"pan",
+			concat(pulse, dmgWrites(0x15, 0x10)),
+			map[uint8]uint8{portVolCh1: 0xF0},
+			nil,
+			nil,
+		},
+		{
+			"master volume",
+			concat(pulse, dmgWrites(0x14, 0x37)),
+			map[uint8]uint8{portVolCh1: 0x8F},
+			nil,
+			nil,
+		},
+		{
+			"power off",
+			concat(pulse, dmgWrites(0x16, 0x00)),
+			map[uint8]uint8{portVolCh1: 0x00},
+			nil,
+			nil,
+		},
+		// the boot ROM pans channels 3 and 4 to the left only
+		{
+			"wave channel",
+			dmgWrites(0x0A, 0x80, 0x20, 0x1F, 0x2F, 0xA5, 0x0C, 0x20, 0x0D, 0x00, 0x0E, 0x87),
+			map[uint8]uint8{portFreqCh1 + 4: 0x89, portFreqCh1 + 5: 0x06, portVolCh1 + 2: 0xF0},
+			map[int]uint8{0x20: 0xF1, 0x2F: 0x5A},
+			nil,
+		},
+		{
+			"wave channel at half volume",
+			dmgWrites(0x0A, 0x80, 0x0C, 0x40, 0x0E, 0x87),
+			map[uint8]uint8{portVolCh1 + 2: 0x80},
+			nil,
+			nil,
+		},
+		{
+			"noise",
+			dmgWrites(0x11, 0xF0, 0x12, 0x00, 0x13, 0x80),
+			map[uint8]uint8{portFreqCh1 + 6: 0xFA, portFreqCh1 + 7: 0x07, portVolCh1 + 3: 0xF0, portNoiseCtrl: 0x10},
+			nil,
+			nil,
+		},
+		{
+			"7-bit noise",
+			dmgWrites(0x11, 0xF0, 0x12, 0x08, 0x13, 0x80),
+			map[uint8]uint8{portNoiseCtrl: 0x11},
+			nil,
+			nil,
+		},
+		{
+			"unknown registers",
+			dmgWrites(0x17, 0x00, 0x1F, 0x00, 0x30, 0x00),
+			nil,
+			nil,
+			map[string]int{"writes to unknown registers": 3},
+		},
+		{
+			"second chip",
+			dmgWrites(0x82, 0xF0, 0x84, 0x87),
+			map[uint8]uint8{portVolCh1: 0x00},
+			nil,
+			map[string]int{"second chip": 2},
+		},
+	}
+	for _, tt := range tests {
+		translator := newDMGTranslator(&vgm.VGMHeader{ClockDMG: 4194304})
+		ws := runTranslator(t, translator, tt.commands)
+		checkPorts(t, tt.name, ws, tt.want)
+		for at, value := range tt.wantWave {
+			if ws.wave[at] != value {
+				t.Errorf("%s: wave byte %02X is %02X, want %02X", tt.name, at, ws.wave[at], value)
+			}
+		}
+		checkDropped(t, tt.name, translator, tt.wantDropped)
+	}
+}
+
+func TestDMGTranslatorTimed(t *testing.T) {
+	tests := []struct {
+		name      string
+		commands  []byte
+		wantTick  uint32
+		wantAfter map[uint8]uint8
+	}{
+		// the length counter is clocked on the first sequencer step
+		{"length", dmgWrites(0x01, 0xBF, 0x02, 0xF0, 0x04, 0xC7), 87, map[uint8]uint8{portVolCh1: 0x00}},
+		// the envelope is clocked on the eighth sequencer step
+		{"envelope", dmgWrites(0x01, 0x80, 0x02, 0xF1, 0x04, 0x87), 690, map[uint8]uint8{portVolCh1: 0xEE}},
+		{"steady", dmgWrites(0x01, 0x80, 0x02, 0xF0, 0x04, 0x87), 0, map[uint8]uint8{portVolCh1: 0xFF}},
+	}
+	for _, tt := range tests {
+		translator := newDMGTranslator(&vgm.VGMHeader{ClockDMG: 4194304})
+		runTranslator(t, translator, tt.commands)
+		tick := translator.untilTick()
+		if tick != tt.wantTick {
+			t.Errorf("%s: next tick in %d samples, want %d", tt.name, tick, tt.wantTick)
+		}
+		translator.advance(tt.wantTick)
+		var ws wsShadow
+		translator.update(&ws)
+		checkPorts(t, tt.name, &ws, tt.wantAfter)
+	}
+}
+
+func TestDMGTranslatorTruncated(t *testing.T) {
+	translator := newDMGTranslator(&vgm.VGMHeader{ClockDMG: 4194304})
+	for _, data := range [][]byte{nil, {0x02}} {
+		if ok, err := translator.command(vgmCommandDMG, bytes.NewReader(data)); !ok || err == nil {
+			t.Errorf("operands % X: got %v, %v, want an error", data, ok, err)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// BankSymbols describes the layout of a written bank, for use by game code.
+type BankSymbols struct {
+	Songs             []string
+	SoundEffects      []string
+	Samples           []string
+	SampleTableOffset uint32
+	Size              uint32
+}
+
+type symbolWriter interface {
+	comment(w io.Writer, text string)
+	define(w io.Writer, name string, value string)
+}
+
+type cSymbolWriter struct{}
+
+func (cSymbolWriter) comment(w io.Writer, text string) {
+	fmt.Fprintf(w, "// %s\n", text)
+}
+
+func (cSymbolWriter) define(w io.Writer, name string, value string) {
+	fmt.Fprintf(w, "#define %s %s\n", name, value)
+}
+
+type nasmSymbolWriter struct{}
+
+func (nasmSymbolWriter) comment(w io.Writer, text string) {
+	fmt.Fprintf(w, "; %s\n", text)
+}
+
+func (nasmSymbolWriter) define(w io.Writer, name string, value string) {
+	fmt.Fprintf(w, "%%define %s %s\n", name, value)
+}
+
+type gasSymbolWriter struct{}
+
+func (gasSymbolWriter) comment(w io.Writer, text string) {
+	fmt.Fprintf(w, "/* %s */\n", text)
+}
+
+func (gasSymbolWriter) define(w io.Writer, name string, value string) {
+	if strings.HasPrefix(value, "\"") {
+		// GAS symbols cannot hold strings
+		fmt.Fprintf(w, "/* %s = %s */\n", name, value)
+	} else {
+		fmt.Fprintf(w, ".set %s, %s\n", name, value)
+	}
+}
+
+// symbolName converts a song or sample name to a valid identifier.
+func symbolName(name string) string {
+	var sb strings.Builder
+	for _, c := range strings.ToUpper(name) {
+		if c < 0x80 && (unicode.IsLetter(c) || unicode.IsDigit(c)) {
+			sb.WriteRune(c)
+		} else {
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
+
+// quoteString quotes a string for use in C and NASM sources.
+func quoteString(s string) string {
+	var sb strings.Builder
+	sb.WriteRune('"')
+	for _, c := range []byte(s) {
+		if c == '"' || c == '\\' {
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		} else if c < 0x20 || c >= 0x7F {
+			sb.WriteByte('?')
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteRune('"')
+	return sb.String()
+}
+
+// symbolSet defines symbols, failing on names which were already defined.
+type symbolSet struct {
+	w       io.Writer
+	sw      symbolWriter
+	defined map[string]bool
+}
+
+func (s *symbolSet) define(name string, value string) error {
+	if s.defined[name] {
+		return fmt.Errorf("symbol %s is defined twice; rename one of its songs, sound effects or samples", name)
+	}
+	s.defined[name] = true
+	s.sw.define(s.w, name, value)
+	return nil
+}
+
+func writeSymbolList(s *symbolSet, prefix string, names []string, withNames bool) error {
+	if err := s.define(prefix+"COUNT", fmt.Sprint(len(names))); err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for i, name := range names {
+		// identical names are numbered; other collisions, such as with the
+		// _NAME symbols, are reported by define
+		symbol := prefix + symbolName(name)
+		for j := 2; used[symbol]; j++ {
+			symbol = fmt.Sprintf("%s%s_%d", prefix, symbolName(name), j)
+		}
+		used[symbol] = true
+		if err := s.define(symbol, fmt.Sprint(i)); err != nil {
+			return err
+		}
+		if withNames {
+			if err := s.define(symbol+"_NAME", quoteString(name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *BankSymbols) write(w io.Writer, sw symbolWriter) error {
+	prefix := SymbolPrefix
+	set := &symbolSet{w, sw, make(map[string]bool)}
+	if err := set.define(prefix+"BANK_SIZE", fmt.Sprint(s.Size)); err != nil {
+		return err
+	}
+	if err := set.define(prefix+"BANK_COUNT", fmt.Sprint((s.Size+0xFFFF)>>16)); err != nil {
+		return err
+	}
+	if len(s.Songs) > 0 {
+		if err := writeSymbolList(set, prefix+"SONG_", s.Songs, true); err != nil {
+			return err
+		}
+	}
+	if len(s.SoundEffects) > 0 {
+		if err := writeSymbolList(set, prefix+"SFX_", s.SoundEffects, true); err != nil {
+			return err
+		}
+	}
+	if len(s.Samples) > 0 {
+		if err := set.define(prefix+"SAMPLE_TABLE_OFFSET", fmt.Sprint(s.SampleTableOffset)); err != nil {
+			return err
+		}
+		if err := writeSymbolList(set, prefix+"SAMPLE_", s.Samples, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSymbolFile(filename string, s *BankSymbols, sw symbolWriter, prologue string) error {
+	var buf bytes.Buffer
+	sw.comment(&buf, "Generated by the vgmswan converter; do not edit.")
+	fmt.Fprint(&buf, prologue)
+	if err := s.write(&buf, sw); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+// WriteHeaders writes the C header and assembly include files requested on
+// the command line.
+func (s *BankSymbols) WriteHeaders() error {
+	if len(HeaderFilename) > 0 {
+		if err := writeSymbolFile(HeaderFilename, s, cSymbolWriter{}, "#pragma once\n"); err != nil {
+			return err
+		}
+	}
+	if len(AsmIncludeFilename) > 0 {
+		var sw symbolWriter
+		switch AsmIncludeSyntax {
+		case "nasm":
+			sw = nasmSymbolWriter{}
+		case "gas":
+			sw = gasSymbolWriter{}
+		default:
+			return fmt.Errorf("unknown assembly syntax %q", AsmIncludeSyntax)
+		}
+		if err := writeSymbolFile(AsmIncludeFilename, s, sw, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/asiekierka/vgmswan/v2/converter/vgm"
+)
+
+const (
+	vgmCommandHuC6280 = 0xB9
+	// register offsets
+	hucRegSelect         = 0x00
+	hucRegBalance        = 0x01
+	hucRegFreqLow        = 0x02
+	hucRegFreqHigh       = 0x03
+	hucRegControl        = 0x04
+	hucRegChannelBalance = 0x05
+	hucRegWave           = 0x06
+	hucRegNoise          = 0x07
+	hucRegLFOFreq        = 0x08
+	hucRegLFOCtrl        = 0x09
+	// control register bits
+	hucControlEnable = 0x80
+	hucControlDDA    = 0x40
+	hucChannelCount  = 6
+)
+
+// HuC6280Channels holds the HuC6280 channel played on each WonderSwan
+// channel, or -1 for none.
+var HuC6280Channels = [4]int{0, 1, 2, 3}
+
+// parseHuC6280Channels parses a channel mapping such as "0145": one HuC6280
+// channel number, or "-" for none, for each WonderSwan channel.
+func parseHuC6280Channels(value string) ([4]int, error) {
+	var result [4]int
+	if len(value) != 4 {
+		return result, fmt.Errorf("invalid HuC6280 channel mapping %q: expected 4 channels", value)
+	}
+	used := 0
+	for i, c := range value {
+		if c == '-' {
+			result[i] = -1
+			continue
+		}
+		if c < '0' || c >= '0'+hucChannelCount {
+			return result, fmt.Errorf("invalid HuC6280 channel mapping %q", value)
+		}
+		if (used & (1 << (c - '0'))) != 0 {
+			return result, fmt.Errorf("invalid HuC6280 channel mapping %q: channel %c is used twice", value, c)
+		}
+		used |= 1 << (c - '0')
+		result[i] = int(c - '0')
+	}
+	return result, nil
+}
+
+// hucChannel is the state of one HuC6280 PSG channel.
+type hucChannel struct {
+	period    uint16
+	control   uint8
+	balance   uint8
+	noise     uint8
+	wave      [wsWaveLength]uint8
+	waveIndex uint8
+}
+
+// huc6280Translator maps up to four of the HuC6280's six wavetable channels
+// onto WonderSwan channels, as selected by HuC6280Channels.
+type huc6280Translator struct {
+	translationReport
+	clock    float64
+	channels [hucChannelCount]hucChannel
+	selected uint8
+	balance  uint8
+	// the WonderSwan channel playing each HuC6280 channel, or -1
+	target [hucChannelCount]int
+}
+
+func newHuC6280Translator(header *vgm.VGMHeader) *huc6280Translator {
+	t := huc6280Translator{
+		clock: float64(header.ClockHUC6280 & 0x3FFFFFFF),
+	}
+	for i := range t.target {
+		t.target[i] = -1
+	}
+	for ws, ch := range HuC6280Channels {
+		if ch >= 0 {
+			t.target[ch] = ws
+		}
+	}
+	return &t
+}
+
+func (t *huc6280Translator) write(reg uint8, value uint8) {
+	switch reg {
+	case hucRegSelect:
+		t.selected = value & 0x07
+		return
+	case hucRegBalance:
+		t.balance = value
+		return
+	case hucRegLFOFreq, hucRegLFOCtrl:
+		if reg == hucRegLFOFreq || (value&0x03) != 0 {
+			t.drop("LFO")
+		}
+		return
+	}
+	if int(t.selected) >= hucChannelCount {
+		return
+	}
+	ch := &t.channels[t.selected]
+	if t.target[t.selected] < 0 {
+		t.drop(fmt.Sprintf("unmapped channel %d", t.selected))
+	}
+	switch reg {
+	case hucRegFreqLow:
+		ch.period = (ch.period & 0xF00) | uint16(value)
+	case hucRegFreqHigh:
+		ch.period = (ch.period & 0x0FF) | uint16(value&0x0F)<<8
+	case hucRegControl:
+		// clearing the enable bit while setting DDA resets the wave index
+		if (value & (hucControlEnable | hucControlDDA)) == hucControlDDA {
+			ch.waveIndex = 0
+		}
+		ch.control = value
+	case hucRegChannelBalance:
+		ch.balance = value
+	case hucRegWave:
+		if (ch.control & hucControlDDA) != 0 {
+			t.drop("DDA samples")
+		} else {
+			// downsample the 5-bit wavetable to 4 bits
+			ch.wave[ch.waveIndex] = (value & 0x1F) >> 1
+			ch.waveIndex = (ch.waveIndex + 1) % wsWaveLength
+		}
+	case hucRegNoise:
+		ch.noise = value
+		if (value&0x80) != 0 && (t.selected < 4 || t.target[t.selected] != 3) {
+			t.drop(fmt.Sprintf("noise on channel %d", t.selected))
+		}
+	}
+}
+
+func (t *huc6280Translator) command(cmd uint8, r io.Reader) (bool, error) {
+	if cmd != vgmCommandHuC6280 {
+		return false, nil
+	}
+	var reg, value uint8
+	if err := binary.Read(r, binary.LittleEndian, &reg); err != nil {
+		return true, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+		return true, err
+	}
+	// only the first chip is translated
+	if (reg & 0x80) == 0 {
+		t.write(reg, value)
+	} else {
+		t.drop("second chip")
+	}
+	return true, nil
+}
+
+// hucAmplitude converts HuC6280 attenuation levels to an amplitude: the
+// channel volume in 1.5dB steps, balances in 3dB steps.
+func hucAmplitude(volume uint8, balance uint8, channelBalance uint8) float64 {
+	if volume == 0 || balance == 0 || channelBalance == 0 {
+		return 0
+	}
+	dB := float64(31-volume)*1.5 + float64(15-balance)*3 + float64(15-channelBalance)*3
+	return math.Pow(10, -dB/20)
+}
+
+func (t *huc6280Translator) update(ws *wsShadow) {
+	chCtrl := uint8(0x0F)
+	ws.ports[portNoiseCtrl] = 0x00
+	for i := 0; i < 4; i++ {
+		ws.setVolume(i, 0, 0)
+	}
+	for i := range t.channels {
+		target := t.target[i]
+		if target < 0 {
+			continue
+		}
+		ch := &t.channels[i]
+		if target == 3 && i >= 4 && (ch.noise&0x80) != 0 {
+			// noise steps at clock / (64 * (~frequency & 0x1F))
+			period := float64((^ch.noise) & 0x1F)
+			if period == 0 {
+				period = 0x20
+			}
+			ws.setRate(target, t.clock/(64*period))
+			ws.ports[portNoiseCtrl] = 0x10
+			chCtrl |= chCtrlNoise
+		} else {
+			period := float64(ch.period)
+			if period == 0 {
+				period = 0x1000
+			}
+			ws.setWave(target, &ch.wave)
+			ws.setFrequency(target, t.clock/(32*period))
+		}
+		if (ch.control&hucControlEnable) != 0 && (ch.control&hucControlDDA) == 0 {
+			volume := ch.control & 0x1F
+			ws.setVolume(target,
+				hucAmplitude(volume, t.balance>>4, ch.balance>>4),
+				hucAmplitude(volume, t.balance&0x0F, ch.balance&0x0F))
+		}
+	}
+	ws.ports[portChCtrl] = chCtrl
+}
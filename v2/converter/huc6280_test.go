@@ -0,0 +1,202 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/asiekierka/vgmswan/v2/converter/vgm"
+)
+
+// hucWrites returns VGM HuC6280 register writes of register, value pairs.
+func hucWrites(writes ...uint8) []byte {
+	result := []byte{}
+	for i := 0; i+1 < len(writes); i += 2 {
+		result = append(result, vgmCommandHuC6280, writes[i], writes[i+1])
+	}
+	return result
+}
+
+func TestParseHuC6280Channels(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    [4]int
+		wantErr bool
+	}{
+		{"0123", [4]int{0, 1, 2, 3}, false},
+		{"5401", [4]int{5, 4, 0, 1}, false},
+		{"01-4", [4]int{0, 1, -1, 4}, false},
+		{"----", [4]int{-1, -1, -1, -1}, false},
+		{"012", [4]int{}, true},
+		{"01234", [4]int{}, true},
+		{"0126", [4]int{}, true},
+		{"0110", [4]int{}, true},
+		{"01a2", [4]int{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseHuC6280Channels(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v, want error %v", tt.value, err, tt.wantErr)
+		} else if !tt.wantErr && got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestHuC6280Translator(t *testing.T) {
+	defer func(v [4]int) { HuC6280Channels = v }(HuC6280Channels)
+
+	// channel 0 at period 0x100 with a square wave, left at full volume
+	var square []uint8
+	for i := 0; i < wsWaveLength; i++ {
+		if i < wsWaveLength/2 {
+			square = append(square, hucRegWave, 0x1F)
+		} else {
+			square = append(square, hucRegWave, 0x00)
+		}
+	}
+	setup := concat(
+		hucWrites(hucRegSelect, 0, hucRegBalance, 0xFF, hucRegFreqLow, 0x00, hucRegFreqHigh, 0x01, hucRegChannelBalance, 0xFF),
+		// reset the wave index before writing the wavetable
+		hucWrites(hucRegControl, hucControlDDA, hucRegControl, 0x00),
+		hucWrites(square...),
+	)
+	tests := []struct {
+		name        string
+		channels    [4]int
+		commands    []byte
+		want        map[uint8]uint8
+		wantDropped map[string]int
+	}{
+		{
+			"tone",
+			[4]int{0, 1, 2, 3},
+			concat(setup, hucWrites(hucRegControl, 0x9F)),
+			map[uint8]uint8{portFreqCh1: 0x24, portFreqCh1 + 1: 0x07, portVolCh1: 0xFF, portChCtrl: 0x0F},
+			nil,
+		},
+		{
+			"volume",
+			[4]int{0, 1, 2, 3},
+			concat(setup, hucWrites(hucRegControl, 0x9D)),
+			map[uint8]uint8{portVolCh1: 0xBB},
+			nil,
+		},
+		{
+			"balance",
+			[4]int{0, 1, 2, 3},
+			concat(setup, hucWrites(hucRegControl, 0x9F, hucRegBalance, 0xF0)),
+			map[uint8]uint8{portVolCh1: 0xF0},
+			nil,
+		},
+		{
+			"disabled channel",
+			[4]int{0, 1, 2, 3},
+			concat(setup, hucWrites(hucRegControl, 0x1F)),
+			map[uint8]uint8{portVolCh1: 0x00},
+			nil,
+		},
+		{
+			"remapped channel",
+			[4]int{-1, 0, 2, 3},
+			concat(setup, hucWrites(hucRegControl, 0x9F)),
+			map[uint8]uint8{portFreqCh1 + 2: 0x24, portFreqCh1 + 3: 0x07, portVolCh1: 0x00, portVolCh1 + 1: 0xFF},
+			nil,
+		},
+		{
+			"DDA samples",
+			[4]int{0, 1, 2, 3},
+			concat(setup, hucWrites(hucRegControl, 0xDF, hucRegWave, 0x10, hucRegWave, 0x08)),
+			map[uint8]uint8{portVolCh1: 0x00},
+			map[string]int{"DDA samples": 2},
+		},
+		{
+			"unmapped channel",
+			[4]int{0, 1, 2, 3},
+			hucWrites(hucRegSelect, 5, hucRegFreqLow, 0x00, hucRegControl, 0x9F),
+			nil,
+			map[string]int{"unmapped channel 5": 2},
+		},
+		{
+			"noise",
+			[4]int{0, 1, 2, 4},
+			hucWrites(hucRegSelect, 4, hucRegBalance, 0xFF, hucRegChannelBalance, 0xFF, hucRegNoise, 0x9F, hucRegControl, 0x9F),
+			map[uint8]uint8{portFreqCh1 + 6: 0x22, portFreqCh1 + 7: 0x01, portVolCh1 + 3: 0xFF, portNoiseCtrl: 0x10, portChCtrl: 0x8F},
+			nil,
+		},
+		{
+			"noise on a tone channel",
+			[4]int{0, 1, 2, 3},
+			hucWrites(hucRegSelect, 3, hucRegNoise, 0x9F),
+			map[uint8]uint8{portNoiseCtrl: 0x00, portChCtrl: 0x0F},
+			map[string]int{"noise on channel 3": 1},
+		},
+		{
+			"LFO",
+			[4]int{0, 1, 2, 3},
+			hucWrites(hucRegLFOFreq, 0x01, hucRegLFOCtrl, 0x00, hucRegLFOCtrl, 0x01),
+			nil,
+			map[string]int{"LFO": 2},
+		},
+		{
+			"second chip",
+			[4]int{0, 1, 2, 3},
+			hucWrites(0x80|hucRegSelect, 0, 0x80|hucRegControl, 0x9F),
+			map[uint8]uint8{portVolCh1: 0x00},
+			map[string]int{"second chip": 2},
+		},
+	}
+	for _, tt := range tests {
+		HuC6280Channels = tt.channels
+		translator := newHuC6280Translator(&vgm.VGMHeader{ClockHUC6280: 3579545})
+		ws := runTranslator(t, translator, tt.commands)
+		checkPorts(t, tt.name, ws, tt.want)
+		checkDropped(t, tt.name, translator, tt.wantDropped)
+	}
+}
+
+func TestHuC6280TranslatorWave(t *testing.T) {
+	defer func(v [4]int) { HuC6280Channels = v }(HuC6280Channels)
+	HuC6280Channels = [4]int{0, 1, 2, 3}
+
+	translator := newHuC6280Translator(&vgm.VGMHeader{ClockHUC6280: 3579545})
+	// 5-bit samples are downsampled, and the wave index wraps around
+	commands := hucWrites(hucRegSelect, 1, hucRegControl, hucControlDDA, hucRegControl, 0x00)
+	for i := 0; i < wsWaveLength; i++ {
+		commands = append(commands, hucWrites(hucRegWave, uint8(i))...)
+	}
+	commands = append(commands, hucWrites(hucRegWave, 0x1F, hucRegWave, 0x1F)...)
+	ws := runTranslator(t, translator, commands)
+	want := []uint8{0xFF, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF}
+	if got := ws.wave[0x10:0x20]; !bytes.Equal(got, want) {
+		t.Errorf("wave: got % X, want % X", got, want)
+	}
+}
+
+func TestHuC6280TranslatorTruncated(t *testing.T) {
+	translator := newHuC6280Translator(&vgm.VGMHeader{ClockHUC6280: 3579545})
+	for _, data := range [][]byte{nil, {hucRegSelect}} {
+		if ok, err := translator.command(vgmCommandHuC6280, bytes.NewReader(data)); !ok || err == nil {
+			t.Errorf("operands % X: got %v, %v, want an error", data, ok, err)
+		}
+	}
+}
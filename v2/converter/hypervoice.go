@@ -0,0 +1,101 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HyperVoice (WonderSwan Color) control port values.
+const (
+	hyperVoiceEnable = 0x80
+	// bits 0-1: volume, as a right shift of the output
+	hyperVoiceShiftNone = 0x00
+	// bits 2-3: scaling mode
+	hyperVoiceScaleUnsigned = 0 << 2
+	hyperVoiceScaleSigned   = 2 << 2
+	hyperVoiceChannelLeft   = 0x20
+	hyperVoiceChannelRight  = 0x40
+	hyperVoiceChannelStereo = 0x10
+	sdmaTargetHyperVoice    = 0x10
+)
+
+var HyperVoice = false
+var HyperVoiceStereo = false
+var HyperVoiceSigned = false
+
+// hyperVoiceChannels returns the amount of interleaved channels in sample data.
+func hyperVoiceChannels() int {
+	if HyperVoice && HyperVoiceStereo {
+		return 2
+	}
+	return 1
+}
+
+// VGM PCM data is mono, and cannot be played in stereo mode.
+var ErrHyperVoiceStereoMono = errors.New("HyperVoice stereo mode requires stereo samples, but VGM PCM data is mono")
+
+// applyHyperVoiceFormat converts unsigned 8-bit PCM data, one slice per
+// channel, to the layout expected by the configured HyperVoice mode.
+func applyHyperVoiceFormat(channels ...[]byte) []byte {
+	if !HyperVoice {
+		return channels[0]
+	}
+	result := make([]byte, len(channels[0])*len(channels))
+	for ch, data := range channels {
+		for i, s := range data {
+			if HyperVoiceSigned {
+				s ^= 0x80
+			}
+			result[i*len(channels)+ch] = s
+		}
+	}
+	return result
+}
+
+// hyperVoiceControl returns the values written to the HyperVoice control
+// ports before playing the given sample.
+func hyperVoiceControl(sample *Sample) (uint8, uint8) {
+	ctrl := uint8(hyperVoiceEnable | hyperVoiceShiftNone)
+	if HyperVoiceSigned {
+		ctrl |= hyperVoiceScaleSigned
+	} else {
+		ctrl |= hyperVoiceScaleUnsigned
+	}
+	switch sample.Frequency {
+	case 24000:
+		ctrl |= 0 << 4
+	case 12000:
+		ctrl |= 1 << 4
+	case 6000:
+		ctrl |= 3 << 4
+	case 4000:
+		ctrl |= 5 << 4
+	default:
+		panic(fmt.Errorf("unknown frequency %d", sample.Frequency))
+	}
+	chanCtrl := uint8(hyperVoiceChannelLeft | hyperVoiceChannelRight)
+	if HyperVoiceStereo {
+		chanCtrl |= hyperVoiceChannelStereo
+	}
+	return ctrl, chanCtrl
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// InstrumentFilename is the instrument definition file used for MIDI songs
+// which do not name their own.
+var InstrumentFilename string
+
+// InstrumentWave is a wavetable, given either as the name of a preset or as
+// 32 samples in the 0 .. 15 range.
+type InstrumentWave [wsWaveLength]uint8
+
+// instrumentPulseWidths holds the amount of high samples of each pulse wave
+// preset.
+var instrumentPulseWidths = map[string]int{
+	"square":  16,
+	"pulse25": 8,
+	"pulse12": 4,
+}
+
+// presetWave returns the wavetable of a named preset.
+func presetWave(name string) (InstrumentWave, error) {
+	var w InstrumentWave
+	for i := range w {
+		if width, ok := instrumentPulseWidths[name]; ok {
+			if i < width {
+				w[i] = 15
+			}
+			continue
+		}
+		switch name {
+		case "triangle":
+			if i < 16 {
+				w[i] = uint8(i)
+			} else {
+				w[i] = uint8(31 - i)
+			}
+		case "saw":
+			w[i] = uint8(i / 2)
+		case "sine":
+			w[i] = uint8(math.Round(7.5 + 7.5*math.Sin(2*math.Pi*float64(i)/wsWaveLength)))
+		default:
+			return w, fmt.Errorf("unknown wave preset %q", name)
+		}
+	}
+	return w, nil
+}
+
+func (w *InstrumentWave) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case string:
+		preset, err := presetWave(v)
+		if err != nil {
+			return err
+		}
+		*w = preset
+	case []interface{}:
+		if len(v) != wsWaveLength {
+			return fmt.Errorf("wave has %d samples, expected %d", len(v), wsWaveLength)
+		}
+		for i, s := range v {
+			f, ok := s.(float64)
+			if !ok || f < 0 || f > 15 || f != math.Trunc(f) {
+				return fmt.Errorf("invalid wave sample %v", s)
+			}
+			w[i] = uint8(f)
+		}
+	default:
+		return fmt.Errorf("invalid wave %s", string(data))
+	}
+	return nil
+}
+
+// Instrument describes how the notes of a MIDI program, or a single drum
+// key, are played.
+type Instrument struct {
+	// program number, drum key, or neither for the default instrument
+	Program *uint8 `json:"program"`
+	Drum    *uint8 `json:"drum"`
+	// note played for drum keys; defaults to the key itself
+	Pitch *uint8 `json:"pitch"`
+	// wavetable; defaults to a square wave
+	Wave *InstrumentWave `json:"wave"`
+	// channels notes may be allocated to; defaults to all of them
+	Channels string `json:"channels"`
+	// volume levels per tick; the last level is held until the note ends
+	Envelope []uint8 `json:"envelope"`
+	// volume levels per tick after the note ends
+	Release []uint8 `json:"release"`
+	// noise tap, playing the instrument as noise on channel 4
+	Noise *uint8 `json:"noise"`
+
+	channelMask uint8
+}
+
+// InstrumentSet is an instrument definition file.
+type InstrumentSet struct {
+	// envelope tick rate, in Hz
+	TickRate    float64       `json:"tickRate"`
+	Instruments []*Instrument `json:"instruments"`
+}
+
+// ReadInstrumentFile reads and checks a JSON instrument definition file.
+func ReadInstrumentFile(filename string) (*InstrumentSet, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	set := InstrumentSet{TickRate: 75.0}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if set.TickRate <= 0 {
+		return nil, fmt.Errorf("%s: invalid tick rate %v", filename, set.TickRate)
+	}
+	for i, inst := range set.Instruments {
+		if len(inst.Channels) == 0 {
+			inst.Channels = "1234"
+			if inst.Noise != nil {
+				inst.Channels = "4"
+			}
+		}
+		channels, ok := parseChannelList(inst.Channels)
+		if !ok || channels == 0 {
+			return nil, fmt.Errorf("%s: instrument %d: invalid channel list %q", filename, i, inst.Channels)
+		}
+		if inst.Noise != nil && (channels != 0x08 || *inst.Noise > 7) {
+			return nil, fmt.Errorf("%s: instrument %d: noise instruments need a tap of 0-7 and channel 4 only", filename, i)
+		}
+		if inst.Program != nil && inst.Drum != nil {
+			return nil, fmt.Errorf("%s: instrument %d: cannot be both a program and a drum", filename, i)
+		}
+		if len(inst.Envelope) == 0 {
+			inst.Envelope = []uint8{15}
+		}
+		if inst.Wave == nil {
+			square, _ := presetWave("square")
+			inst.Wave = &square
+		}
+		for _, level := range append(inst.Envelope, inst.Release...) {
+			if level > 15 {
+				return nil, fmt.Errorf("%s: instrument %d: invalid volume level %d", filename, i, level)
+			}
+		}
+		inst.channelMask = channels
+	}
+	return &set, nil
+}
+
+// find returns the instrument for a program, or for a drum key if drum is
+// set, falling back to the default instrument.
+func (s *InstrumentSet) find(program uint8, drum bool) *Instrument {
+	var fallback *Instrument
+	for _, inst := range s.Instruments {
+		if drum && inst.Drum != nil && *inst.Drum == program {
+			return inst
+		} else if !drum && inst.Program != nil && *inst.Program == program {
+			return inst
+		} else if inst.Program == nil && inst.Drum == nil && fallback == nil {
+			fallback = inst
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readTestInstruments writes an instrument definition file to a temporary
+// directory and reads it.
+func readTestInstruments(t *testing.T, data string) (*InstrumentSet, error) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "instruments.json")
+	if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ReadInstrumentFile(filename)
+}
+
+func TestPresetWave(t *testing.T) {
+	tests := []struct {
+		name string
+		at   []int
+		want []uint8
+	}{
+		{"square", []int{0, 15, 16, 31}, []uint8{15, 15, 0, 0}},
+		{"pulse25", []int{7, 8}, []uint8{15, 0}},
+		{"pulse12", []int{3, 4}, []uint8{15, 0}},
+		{"triangle", []int{0, 15, 16, 31}, []uint8{0, 15, 15, 0}},
+		{"saw", []int{0, 1, 2, 31}, []uint8{0, 0, 1, 15}},
+		{"sine", []int{0, 8, 16, 24}, []uint8{8, 15, 8, 0}},
+	}
+	for _, tt := range tests {
+		w, err := presetWave(tt.name)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		for i, at := range tt.at {
+			if w[at] != tt.want[i] {
+				t.Errorf("%s: sample %d is %d, want %d", tt.name, at, w[at], tt.want[i])
+			}
+		}
+	}
+	if _, err := presetWave("organ"); err == nil {
+		t.Error("unknown preset: expected an error")
+	}
+}
+
+func TestReadInstrumentFile(t *testing.T) {
+	set, err := readTestInstruments(t, `{
+		"instruments": [
+			{"program": 5, "wave": "triangle", "channels": "12", "envelope": [15, 8], "release": [4]},
+			{"drum": 36, "noise": 3},
+			{}
+		]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.TickRate != 75 {
+		t.Errorf("tick rate: got %v, want 75", set.TickRate)
+	}
+	program, drum, fallback := set.Instruments[0], set.Instruments[1], set.Instruments[2]
+	if program.channelMask != 0x03 || drum.channelMask != 0x08 || fallback.channelMask != 0x0F {
+		t.Errorf("channel masks: got %X %X %X, want 3 8 F", program.channelMask, drum.channelMask, fallback.channelMask)
+	}
+	if len(fallback.Envelope) != 1 || fallback.Envelope[0] != 15 || fallback.Wave == nil || fallback.Wave[0] != 15 {
+		t.Errorf("defaults: got envelope %v, wave %v", fallback.Envelope, fallback.Wave)
+	}
+	if got := set.find(5, false); got != program {
+		t.Errorf("program 5: got %+v", got)
+	}
+	if got := set.find(36, true); got != drum {
+		t.Errorf("drum 36: got %+v", got)
+	}
+	if got := set.find(6, false); got != fallback {
+		t.Errorf("program 6: got %+v, want the default instrument", got)
+	}
+}
+
+func TestReadInstrumentFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"invalid JSON", `{"instruments": [`},
+		{"invalid tick rate", `{"tickRate": 0}`},
+		{"invalid channels", `{"instruments": [{"channels": "15"}]}`},
+		{"noise on a tone channel", `{"instruments": [{"noise": 1, "channels": "3"}]}`},
+		{"invalid noise tap", `{"instruments": [{"noise": 8}]}`},
+		{"program and drum", `{"instruments": [{"program": 1, "drum": 36}]}`},
+		{"invalid volume level", `{"instruments": [{"envelope": [16]}]}`},
+		{"invalid release level", `{"instruments": [{"release": [20]}]}`},
+		{"unknown wave preset", `{"instruments": [{"wave": "organ"}]}`},
+		{"short wave", `{"instruments": [{"wave": [1, 2, 3]}]}`},
+		{"invalid wave sample", `{"instruments": [{"wave": [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 16]}]}`},
+	}
+	for _, tt := range tests {
+		if _, err := readTestInstruments(t, tt.data); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
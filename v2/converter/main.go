@@ -21,6 +21,7 @@
 package main
 
 import (
+	"bytes"
 	_ "embed"
 	"encoding/binary"
 	"errors"
@@ -29,6 +30,8 @@ import (
 	"io"
 	"os"
 	"reflect"
+	"sort"
+	"strconv"
 
 	"github.com/asiekierka/vgmswan/v2/converter/vgm"
 	"github.com/oov/audio/resampler"
@@ -41,18 +44,43 @@ var HBlankTiming = true
 var DisablePCM = false
 var DisableResampling = false
 var OneSongMode = false
+var Mapper2003Banks = false
+var GlobalWavetables = false
+var WaveBase = -1
 var BuildTestROM = false
 var OutputFilename = ""
+var SampleFiles SampleFileList
+var SoundEffectFiles SoundEffectFileList
+var MutedChannels uint8
+var VolumeScale = 1.0
+var FadeOutSeconds = 0.0
+var StereoMode = stereoKeep
+var PanOffsets [4]int
+var ManifestFilename = ""
+var HeaderFilename = ""
+var AsmIncludeFilename = ""
+var AsmIncludeSyntax = "nasm"
+var SymbolPrefix = ""
+var UseGD3Names = false
+var OutputFormat = "raw"
+var ObjectSymbolName = "vgmswan_bank"
+var ObjectSectionName = ".rom0.vgmswan"
 
 //go:embed engine.bin
-var engineBin []byte
+var engineHBlankBin []byte
+
+//go:embed engine_vblank.bin
+var engineVBlankBin []byte
+
 var romSizeToHeaderValue = map[int]byte{
 	128 * 1024:       0,
 	256 * 1024:       1,
 	512 * 1024:       2,
 	1024 * 1024:      3,
 	2 * 1024 * 1024:  4,
+	3 * 1024 * 1024:  5,
 	4 * 1024 * 1024:  6,
+	6 * 1024 * 1024:  7,
 	8 * 1024 * 1024:  8,
 	16 * 1024 * 1024: 9,
 }
@@ -96,6 +124,14 @@ type CommandPlaySample struct {
 	Reverse      bool
 }
 
+type CommandAttenuation struct {
+	Level uint8
+}
+
+type CommandMarker struct {
+	ID uint8
+}
+
 type CommandJump struct {
 	TargetSample uint32
 }
@@ -106,15 +142,34 @@ type CommandFrame struct {
 	LoopFrame bool
 }
 
+// Callable reports whether the frame can be the target of a 0xEF frame call,
+// which runs until the next wait. Frames split at the loop offset may not end
+// with one.
+func (f *CommandFrame) Callable() bool {
+	if len(f.Commands) == 0 {
+		return false
+	}
+	_, ok := f.Commands[len(f.Commands)-1].(*CommandWait)
+	return ok
+}
+
 type Song struct {
 	Samples      []*Sample
 	Commands     []*CommandFrame
 	LoopPosition uint32
+	LoopCount    int
+	Name         string
+	// markers positioned past the end of the song, and memory writes
+	// outside of the wavetables, which were not converted
+	DroppedMarkers    int
+	DroppedWaveWrites int
 }
 
 type BankData struct {
-	Samples []*Sample
-	Songs   []*Song
+	Samples      []*Sample
+	Songs        []*Song
+	SampleTable  []*NamedSample
+	SoundEffects []*SoundEffect
 }
 
 type ConvertedSampleKey struct {
@@ -132,6 +187,40 @@ func NewConvertedSampleMap() ConvertedSampleMap {
 	return c
 }
 
+// resampleTargetFrequency picks the hardware playback rate a sample of the
+// given frequency is resampled to.
+func resampleTargetFrequency(freq uint32) uint32 {
+	if freq <= 4500 {
+		return 4000
+	} else if freq <= 7000 {
+		return 6000
+	} else {
+		return 12000
+	}
+}
+
+// resampleFloat32 converts floating point PCM data in the -1.0 .. 1.0 range
+// from one frequency to another, returning unsigned 8-bit PCM data.
+func resampleFloat32(input []float32, inFreq uint32, outFreq uint32) []byte {
+	outDataLen := int((uint64(len(input)) * uint64(outFreq)) / uint64(inFreq))
+	outputDataFloat := make([]float32, outDataLen)
+	if inFreq == outFreq {
+		copy(outputDataFloat, input)
+	} else {
+		resampler.Resample32(input, int(inFreq), outputDataFloat, int(outFreq), 10)
+	}
+	outputData := make([]byte, outDataLen)
+	for i, s := range outputDataFloat {
+		if s > 1.0 {
+			s = 1.0
+		} else if s < -1.0 {
+			s = -1.0
+		}
+		outputData[i] = byte((s * 127.5) + 127.5)
+	}
+	return outputData
+}
+
 func (c *ConvertedSampleMap) ConvertSample(idx uint16, freq uint32, data PCMSampleData) (*Sample, bool) {
 	key := ConvertedSampleKey{
 		idx, freq,
@@ -153,7 +242,8 @@ func (c *ConvertedSampleMap) ConvertSample(idx uint16, freq uint32, data PCMSamp
 		} else {
 			sample := Sample{}
 			sample.Frequency = key.frequency
-			sample.Data = &data.Data
+			sampleData := applyHyperVoiceFormat(data.Data)
+			sample.Data = &sampleData
 			c.data[key] = &sample
 			return &sample, true
 		}
@@ -163,27 +253,15 @@ func (c *ConvertedSampleMap) ConvertSample(idx uint16, freq uint32, data PCMSamp
 		} else {
 			// resample
 			sample := Sample{}
-			sample.Frequency = 12000
-			if freq <= 7000 {
-				sample.Frequency = 6000
-				if freq <= 4500 {
-					sample.Frequency = 4000
-				}
-			}
+			sample.Frequency = resampleTargetFrequency(freq)
 
 			inputDataFloat := make([]float32, len(data.Data))
 			for i, s := range data.Data {
 				inputDataFloat[i] = (float32(s) - 127.5) / 127.5
 			}
-			outDataLen := int((uint64(len(data.Data)) * uint64(sample.Frequency)) / uint64(freq))
-			outputDataFloat := make([]float32, outDataLen)
-			resampler.Resample32(inputDataFloat, int(freq), outputDataFloat, int(sample.Frequency), 10)
-			outputData := make([]byte, outDataLen)
-			for i, s := range outputDataFloat {
-				outputData[i] = byte((s * 127.5) + 127.5)
-			}
+			outputData := applyHyperVoiceFormat(resampleFloat32(inputDataFloat, freq, sample.Frequency))
 
-			fmt.Printf("resampled sample %d: %d Hz(%d bytes) to %d hz(%d bytes)\n", idx, freq, len(data.Data), sample.Frequency, outDataLen)
+			fmt.Printf("resampled sample %d: %d Hz(%d bytes) to %d hz(%d bytes)\n", idx, freq, len(data.Data), sample.Frequency, len(outputData))
 
 			sample.Data = &outputData
 			c.data[key] = &sample
@@ -196,7 +274,7 @@ var (
 	ErrUnsupportedSongFile = errors.New("unsupported song file")
 )
 
-func parseVGM(r io.ReadSeeker) (*Song, error) {
+func parseVGM(r io.ReadSeeker, markers []Marker) (*Song, error) {
 	var song Song
 	header, err := vgm.ReadVGMHeader(r)
 	if err != nil {
@@ -204,9 +282,16 @@ func parseVGM(r io.ReadSeeker) (*Song, error) {
 	}
 
 	// TODO: more error checking?
+	var translator chipTranslator
+	var shadow wsShadow
+	wave := newWaveRAM()
 	if header.ClockWonderSwan == 0 {
-		return nil, ErrUnsupportedSongFile
+		translator = newChipTranslator(header)
+		if translator == nil {
+			return nil, ErrUnsupportedSongFile
+		}
 	}
+	song.LoopCount = defaultLoopCount(header)
 
 	var pcmSampleData []PCMSampleData
 	convertedSamples := NewConvertedSampleMap()
@@ -238,6 +323,13 @@ func parseVGM(r io.ReadSeeker) (*Song, error) {
 	if newSamplePos == song.LoopPosition {
 		frame.LoopFrame = true
 	}
+	markerIdx := 0
+	emitMarkers := func() {
+		for markerIdx < len(markers) && markers[markerIdx].Position <= samplePos {
+			frame.Commands = append(frame.Commands, &CommandMarker{markers[markerIdx].ID})
+			markerIdx++
+		}
+	}
 	for running {
 		// check for loop offset
 		filePos, err := r.Seek(0, io.SeekCurrent)
@@ -247,6 +339,16 @@ func parseVGM(r io.ReadSeeker) (*Song, error) {
 		if filePos == int64(header.LoopOffset) {
 			requestSampleReset = true
 			song.LoopPosition = samplePos
+			// the loop may be reached from a different chip state
+			shadow.invalidate()
+			wave.emit(&frame)
+			wave.invalidate()
+			if len(frame.Commands) > 0 {
+				newFrame := frame
+				song.Commands = append(song.Commands, &newFrame)
+				frame = CommandFrame{}
+			}
+			frame.LoopFrame = true
 		}
 
 		// parse command
@@ -259,6 +361,12 @@ func parseVGM(r io.ReadSeeker) (*Song, error) {
 			return nil, err
 		}
 		switch cmd {
+		case vgmMarkerCommand:
+			var id uint8
+			binary.Read(r, binary.LittleEndian, &id)
+			if VGMMarkers {
+				frame.Commands = append(frame.Commands, &CommandMarker{id})
+			}
 		case 0x61:
 			var length uint16
 			binary.Read(r, binary.LittleEndian, &length)
@@ -322,6 +430,9 @@ func parseVGM(r io.ReadSeeker) (*Song, error) {
 				if !found {
 					return nil, fmt.Errorf("could not find sample data for offset %d", offset)
 				}
+				if HyperVoiceStereo {
+					return nil, ErrHyperVoiceStereoMono
+				}
 				sample, isNew := convertedSamples.ConvertSample(blockId, stream.Frequency, pcmSampleData[blockId])
 				if isNew {
 					song.Samples = append(song.Samples, sample)
@@ -366,6 +477,9 @@ func parseVGM(r io.ReadSeeker) (*Song, error) {
 					return nil, fmt.Errorf("missing PCM data block %d", blockId)
 				}
 				cmd := CommandPlaySample{}
+				if HyperVoiceStereo {
+					return nil, ErrHyperVoiceStereoMono
+				}
 				sample, isNew := convertedSamples.ConvertSample(blockId, stream.Frequency, pcmSampleData[blockId])
 				if isNew {
 					song.Samples = append(song.Samples, sample)
@@ -381,7 +495,13 @@ func parseVGM(r io.ReadSeeker) (*Song, error) {
 			var addr, data uint8
 			binary.Read(r, binary.LittleEndian, &addr)
 			binary.Read(r, binary.LittleEndian, &data)
-			if addr == 0x0F || addr == 0x11 {
+			if addr == 0x0F {
+				if err := wave.setBase(&frame, data); err != nil {
+					return nil, err
+				}
+				break
+			}
+			if addr == 0x11 {
 				// skip these!
 				break
 			}
@@ -411,25 +531,59 @@ func parseVGM(r io.ReadSeeker) (*Song, error) {
 			var data uint8
 			binary.Read(r, binary.BigEndian, &addr)
 			binary.Read(r, binary.LittleEndian, &data)
-			if addr >= 0x40 {
-				return nil, fmt.Errorf("unsupported WonderSwan memory address: %04X", addr)
+			wave.write(&frame, addr, data)
+		default:
+			if (cmd & 0xF0) == 0x70 {
+				// short wait
+				newSamplePos = samplePos + uint32(cmd&0x0F) + 1
+				break
 			}
-			if cmd, ok := lastCommand.(*CommandWriteMemory); ok && cmd.Address == uint16(int(addr)-len(cmd.Data)) && (addr&0x0F) != 0 {
-				cmd.Data = append(cmd.Data, data)
-			} else {
-				frame.Commands = append(frame.Commands, &CommandWriteMemory{
-					addr, []byte{data},
-				})
+			if translator != nil {
+				if ok, err := translator.command(cmd, r); err != nil {
+					return nil, err
+				} else if ok {
+					break
+				}
 			}
-		default:
 			return nil, fmt.Errorf("unknown command %02X", cmd)
 		}
+		if translator != nil && newSamplePos > samplePos {
+			translator.update(&shadow)
+			shadow.emit(&frame)
+		}
 		if newSamplePos > samplePos {
-			// TODO: support vblank mode
-			waitTime := ((newSamplePos-samplePos)*120 + 440) / 441
+			wave.emit(&frame)
+		}
+		emitMarkers()
+		// split waits are measured from the start of the whole wait, so that
+		// their rounding errors do not add up
+		waitStart := samplePos
+		roundedWait := func(pos uint32) uint32 {
+			waitTime := ((pos-waitStart)*120 + 440) / 441
 			if !HBlankTiming {
 				waitTime = (waitTime + 158) / 159
 			}
+			return waitTime
+		}
+		for newSamplePos > samplePos {
+			// split waits at marker positions
+			targetSamplePos := newSamplePos
+			if markerIdx < len(markers) && markers[markerIdx].Position < targetSamplePos {
+				targetSamplePos = markers[markerIdx].Position
+			}
+			// ... and where a translated chip changes its own state
+			timed, isTimed := translator.(timedTranslator)
+			if isTimed {
+				if ticks := timed.untilTick(); ticks > 0 && samplePos+ticks < targetSamplePos {
+					targetSamplePos = samplePos + ticks
+				}
+			}
+			// TODO: support vblank mode
+			waitTime := roundedWait(targetSamplePos) - roundedWait(samplePos)
+			if isTimed {
+				// waits are split finely; avoid accumulating rounding errors
+				waitTime = waitUnits(targetSamplePos) - waitUnits(samplePos)
+			}
 			if waitTime > 0 {
 				frame.Commands = append(frame.Commands, &CommandWait{
 					waitTime,
@@ -437,71 +591,315 @@ func parseVGM(r io.ReadSeeker) (*Song, error) {
 				newFrame := frame
 				song.Commands = append(song.Commands, &newFrame)
 				frame = CommandFrame{}
-				if newSamplePos == song.LoopPosition {
+				if targetSamplePos == song.LoopPosition {
 					frame.LoopFrame = true
 				}
 			}
-			samplePos = newSamplePos
+			if isTimed {
+				timed.advance(targetSamplePos - samplePos)
+				timed.update(&shadow)
+				shadow.emit(&frame)
+			}
+			samplePos = targetSamplePos
+			emitMarkers()
 		}
 	}
 
+	if translator != nil {
+		// timed translators split waits at every tick, changed or not
+		mergeWaits(&song)
+		translator.dropped().print()
+	}
+	song.DroppedMarkers = len(markers) - markerIdx
+	song.DroppedWaveWrites = wave.dropped()
 	return &song, nil
 }
 
+// bankPositionSize returns the size of a position operand: an offset, plus
+// a bank delta unless in one song mode.
+func bankPositionSize() int {
+	if OneSongMode {
+		return 2
+	} else if Mapper2003Banks {
+		return 4
+	} else {
+		return 3
+	}
+}
+
+// maxBankCount returns the number of 64KiB banks addressable by bank deltas.
+func maxBankCount() int {
+	if Mapper2003Banks {
+		return 65536
+	} else {
+		return 256
+	}
+}
+
 func writeBankPosition(w io.Writer, currentPosition uint32, writtenPosition uint32) error {
 	pos := uint16(writtenPosition & 0xFFFF)
 	if OneSongMode {
 		_, err := w.Write([]byte{uint8(pos), uint8(pos >> 8)})
 		return err
+	}
+	if int(writtenPosition>>16) >= maxBankCount() || int(currentPosition>>16) >= maxBankCount() {
+		return fmt.Errorf("position %06X is past the last addressable bank; try -mapper-2003", writtenPosition)
+	}
+	// bank deltas wrap around, as the engine's bank register does
+	bank := uint16((writtenPosition >> 16) - (currentPosition >> 16))
+	if Mapper2003Banks {
+		_, err := w.Write([]byte{uint8(pos), uint8(pos >> 8), uint8(bank), uint8(bank >> 8)})
+		return err
 	} else {
-		bank := uint8(((writtenPosition & 0xFF0000) - (currentPosition & 0xFF0000)) >> 16)
-		_, err := w.Write([]byte{uint8(pos), uint8(pos >> 8), bank})
+		_, err := w.Write([]byte{uint8(pos), uint8(pos >> 8), uint8(bank)})
 		return err
 	}
 }
 
+// romTargetSize returns the smallest ROM size with a header value which can
+// hold size bytes.
+func romTargetSize(size int) (int, byte, error) {
+	romSizes := make([]int, 0, len(romSizeToHeaderValue))
+	for romSize := range romSizeToHeaderValue {
+		romSizes = append(romSizes, romSize)
+	}
+	sort.Ints(romSizes)
+	for _, romSize := range romSizes {
+		if romSize >= size {
+			return romSize, romSizeToHeaderValue[romSize], nil
+		}
+	}
+	return 0, 0, fmt.Errorf("test ROM needs %d bytes, more than the largest ROM size of %d bytes", size, romSizes[len(romSizes)-1])
+}
+
+// encodeCommand returns the bytecode of a command, with memory writes
+// always written inline.
+func encodeCommand(cmdRaw interface{}) []byte {
+	cmdBuffer := []byte{}
+	switch cmd := cmdRaw.(type) {
+	case *CommandWritePort:
+		if len(cmd.Data) == 2 {
+			cmdBuffer = append(cmdBuffer, append([]byte{0x60 + cmd.Address}, cmd.Data...)...)
+		} else if len(cmd.Data) == 1 {
+			cmdBuffer = append(cmdBuffer, append([]byte{0x40 + cmd.Address}, cmd.Data...)...)
+		} else {
+			panic(fmt.Errorf("unknown port write data length %+v", cmd))
+		}
+	case *CommandWriteMemory:
+		cmdBuffer = append(cmdBuffer, append([]byte{uint8(cmd.Address), uint8(len(cmd.Data))}, cmd.Data...)...)
+	case *CommandWait:
+		if cmd.Length >= 256 {
+			cmdBuffer = append(cmdBuffer, 0xF9, uint8(cmd.Length), uint8(cmd.Length>>8))
+		} else if cmd.Length > 7 {
+			cmdBuffer = append(cmdBuffer, 0xF8, uint8(cmd.Length))
+		} else if cmd.Length > 0 {
+			cmdBuffer = append(cmdBuffer, 0xEF+uint8(cmd.Length))
+		}
+	case *CommandMarker:
+		cmdBuffer = append(cmdBuffer, 0xEA, cmd.ID)
+	case *CommandAttenuation:
+		cmdBuffer = append(cmdBuffer, 0xEC, cmd.Level)
+	case *CommandPlaySample:
+		if cmd.Sample == nil {
+			cmdBuffer = append(cmdBuffer, 0xFB, 0x00)
+		} else {
+			ctrl := sampleControlByte(cmd.Sample, cmd.Repeat, cmd.Reverse)
+			pos := uint16(cmd.Sample.FilePosition + uint32(cmd.CustomOffset))
+			len := uint16(len(*cmd.Sample.Data))
+			if cmd.CustomLength > 0 {
+				len = cmd.CustomLength
+			}
+			if cmd.Reverse {
+				pos += len - 1
+			}
+			if HyperVoice {
+				hvCtrl, hvChanCtrl := hyperVoiceControl(cmd.Sample)
+				cmdBuffer = append(cmdBuffer, 0xEE, hvCtrl, hvChanCtrl)
+			}
+			cmdBuffer = append(cmdBuffer, 0xFB, ctrl, uint8(pos), uint8(pos>>8), uint8(len), uint8(len>>8))
+		}
+	default:
+		panic(fmt.Errorf("unknown command type %+v", cmd))
+	}
+	return cmdBuffer
+}
+
 func init() {
 	flag.BoolVar(&DisablePCM, "disable-pcm", false, "Disable PCM samples.")
 	flag.BoolVar(&DisableResampling, "disable-resampling", false, "Disable resampling.")
 	flag.BoolVar(&Enable24KHzSamples, "enable-24khz-samples", false, "Enable 24kHz samples.")
+	flag.BoolVar(&HyperVoice, "hypervoice", false, "Play PCM samples through HyperVoice (WonderSwan Color only).")
+	flag.BoolVar(&HyperVoiceStereo, "hypervoice-stereo", false, "Use HyperVoice stereo mode, playing both channels of stereo WAV samples; VGM PCM data is not supported.")
+	flag.BoolVar(&HyperVoiceSigned, "hypervoice-signed", false, "Store HyperVoice sample data as signed.")
 	flag.BoolVar(&HBlankTiming, "hblank-timing", false, "Time to HBlank instead of VBlank.")
 	flag.BoolVar(&OneSongMode, "one-song", false, "Do not emit song list at the beginning; do not split across multiple banks.")
+	flag.BoolVar(&Mapper2003Banks, "mapper-2003", false, "Emit 16-bit bank deltas, for engines built with VGMSWAN_MAPPER_2003.")
+	flag.BoolVar(&GlobalWavetables, "global-wavetables", false, "Store repeated wavetables once in the first bank, for engines built with VGMSWAN_GLOBAL_WAVETABLES.")
+	flag.Func("wave-base", "Set the wave base port so that song wavetables start at this address, for example 0x1800, moving wave base changes with it; by default, the wave base is left to the engine.", func(value string) error {
+		base, err := parseWaveBase(value)
+		WaveBase = base
+		return err
+	})
+	flag.Func("mute", "Drop all writes to the given channels, for example \"24\".", func(value string) error {
+		channels, ok := parseChannelList(value)
+		if !ok {
+			return fmt.Errorf("invalid channel list %q", value)
+		}
+		MutedChannels = channels
+		return nil
+	})
+	flag.Func("huc6280-channels", "HuC6280 channel played on each WonderSwan channel, or - for none (default \"0123\").", func(value string) error {
+		channels, err := parseHuC6280Channels(value)
+		HuC6280Channels = channels
+		return err
+	})
+	flag.Float64Var(&AYEnvelopeRate, "ay-envelope-rate", 75.0, "Rate at which AY-3-8910 envelopes are converted to volume writes, in Hz.")
+	flag.StringVar(&InstrumentFilename, "instruments", "", "Instrument definition file for MIDI songs.")
+	flag.Func("volume", "Scale all channel volumes by the given factor (default 1).", func(value string) error {
+		scale, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		VolumeScale = scale
+		return checkVolumeScale(scale)
+	})
+	flag.Func("stereo", "Rewrite channel volumes as stereo (default), mono, or swap (left and right exchanged).", func(value string) error {
+		mode, err := parseStereoMode(value)
+		StereoMode = mode
+		return err
+	})
+	flag.Func("pan", "Pan offset for each channel, from -15 (left) to 15 (right), for example \"-4:0:0:4\".", func(value string) error {
+		pan, err := parsePanOffsets(value)
+		PanOffsets = pan
+		return err
+	})
+	flag.Float64Var(&FadeOutSeconds, "fade-out", 0, "Replace song looping with a fade-out of the given length, in seconds.")
 	flag.BoolVar(&BuildTestROM, "t", false, "Output playback ROM.")
 	flag.StringVar(&OutputFilename, "o", "", "Output filename.")
+	flag.StringVar(&EngineFilename, "engine", "", "Build the test ROM with this engine image instead of the embedded one; it must match the timing mode.")
+	ROMHeader.registerFlags()
+	flag.StringVar(&HeaderFilename, "header", "", "Write song, sound effect and sample symbols to a C header.")
+	flag.StringVar(&AsmIncludeFilename, "asm-include", "", "Write song, sound effect and sample symbols to an assembly include file.")
+	flag.StringVar(&AsmIncludeSyntax, "asm-syntax", "nasm", "Assembly include syntax: nasm or gas.")
+	flag.StringVar(&SymbolPrefix, "symbol-prefix", "", "Prefix for generated symbols.")
+	flag.BoolVar(&VGMMarkers, "vgm-markers", false, "Read markers embedded in VGM files as reserved command 0x3E.")
+	flag.BoolVar(&UseGD3Names, "gd3-names", false, "Name songs after their GD3 track titles, where not named explicitly.")
+	flag.StringVar(&OutputFormat, "format", "raw", "Output format: raw, c (C array source) or elf (relocatable object).")
+	flag.StringVar(&ObjectSymbolName, "object-symbol", "vgmswan_bank", "Symbol name prefix for C and ELF output; the bank index is appended.")
+	flag.StringVar(&ObjectSectionName, "object-section", ".rom0.vgmswan", "Section name for C and ELF output, holding all banks in order.")
+	flag.StringVar(&ManifestFilename, "manifest", "", "Read songs, samples, sound effects and options from a JSON manifest.")
+	flag.Var(&SoundEffectFiles, "sfx", "Add a VGM file to the sound effect bank: file.vgm[,name=NAME][,priority=0-15][,channels=1234]. May be repeated; cannot be combined with songs.")
+	flag.Var(&SampleFiles, "sample", "Add a WAV file to the sample table: file.wav[,name=NAME][,trim=START:END][,gain=GAIN][,rate=HZ]. May be repeated.")
 }
 
 func main() {
 	var data BankData
 
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:]))
+	}
+
 	flag.Parse()
-	if flag.NArg() <= 0 {
-		fmt.Fprintln(os.Stderr, "Please provide at least one song.")
+	var songFiles []*SongFile
+	if len(ManifestFilename) > 0 {
+		manifest, err := ReadManifest(ManifestFilename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		// command line flags take precedence over manifest options
+		flagsSet := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			flagsSet[f.Name] = true
+		})
+		songFiles, err = manifest.Apply(flagsSet)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	for _, songArg := range flag.Args() {
+		songFile, err := ParseSongFile(songArg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		songFiles = append(songFiles, songFile)
+	}
+	if len(songFiles) <= 0 && len(SampleFiles) <= 0 && len(SoundEffectFiles) <= 0 {
+		fmt.Fprintln(os.Stderr, "Please provide at least one song, sample or sound effect.")
 		flag.Usage()
 		os.Exit(1)
 	}
+	if len(SoundEffectFiles) > 0 && (len(songFiles) > 0 || OneSongMode || BuildTestROM) {
+		fmt.Fprintln(os.Stderr, "Sound effect banks cannot contain songs.")
+		os.Exit(1)
+	}
 	if len(OutputFilename) <= 0 {
 		fmt.Fprintln(os.Stderr, "Please provide a valid output filename.")
 		flag.Usage()
 		os.Exit(1)
 	}
-	if BuildTestROM {
-		// TODO: Remove this requirement.
-		HBlankTiming = true
+	if OutputFormat != "raw" && OutputFormat != "c" && OutputFormat != "elf" {
+		fmt.Fprintln(os.Stderr, "Please provide a valid output format: raw, c or elf.")
+		os.Exit(1)
 	}
-
-	for _, songFilename := range flag.Args() {
-		songReader, err := os.Open(songFilename)
+	if OutputFormat != "raw" && BuildTestROM {
+		fmt.Fprintln(os.Stderr, "Test ROMs can only be written in the raw format.")
+		os.Exit(1)
+	}
+	// the engine's playback loop must match the song's wait units
+	engineBin := engineVBlankBin
+	if HBlankTiming {
+		engineBin = engineHBlankBin
+	}
+	if len(EngineFilename) > 0 {
+		if !BuildTestROM {
+			fmt.Fprintln(os.Stderr, "An engine image can only be used when building a test ROM.")
+			os.Exit(1)
+		}
+		var err error
+		engineBin, err = LoadEngine(EngineFilename)
 		if err != nil {
-			panic(err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		defer songReader.Close()
-
-		song, err := parseVGM(songReader)
+	}
+	if Mapper2003Banks && BuildTestROM {
+		fmt.Fprintln(os.Stderr, "The test ROM engine does not support 16-bit bank deltas.")
+		os.Exit(1)
+	}
+	if GlobalWavetables && BuildTestROM && len(EngineFilename) <= 0 {
+		fmt.Fprintln(os.Stderr, "The built-in test ROM engine does not support global wavetables; build one with VGMSWAN_GLOBAL_WAVETABLES and pass it with -engine.")
+		os.Exit(1)
+	}
+	if AsmIncludeSyntax != "nasm" && AsmIncludeSyntax != "gas" {
+		fmt.Fprintln(os.Stderr, "Please provide a valid assembly syntax: nasm or gas.")
+		os.Exit(1)
+	}
+	if AYEnvelopeRate <= 0 {
+		fmt.Fprintln(os.Stderr, "Please provide a positive AY-3-8910 envelope rate.")
+		os.Exit(1)
+	}
+	if HyperVoiceStereo && DisableResampling {
+		fmt.Fprintln(os.Stderr, "HyperVoice stereo mode requires resampling.")
+		os.Exit(1)
+	}
+	for _, songFile := range songFiles {
+		song, err := LoadSong(songFile)
 		if err != nil {
 			panic(err)
 		}
 		data.Songs = append(data.Songs, song)
 	}
+	for _, sfxFile := range SoundEffectFiles {
+		sfx, err := ConvertSoundEffectFile(sfxFile)
+		if err != nil {
+			panic(err)
+		}
+		data.SoundEffects = append(data.SoundEffects, sfx)
+		data.Songs = append(data.Songs, sfx.Song)
+	}
 
 	// deduplicate and populate samples
 	sampleDedupMap := make(map[*Sample]*Sample)
@@ -523,58 +921,117 @@ func main() {
 		}
 	}
 
+	// convert standalone samples
+	for _, sampleFile := range SampleFiles {
+		sample, err := ConvertSampleFile(sampleFile)
+		if err != nil {
+			panic(err)
+		}
+		data.Samples = append(data.Samples, sample)
+		data.SampleTable = append(data.SampleTable, &NamedSample{sampleFile.Name, sample})
+	}
+
 	if OneSongMode && len(data.Songs) != 1 {
 		fmt.Fprintln(os.Stderr, "Please provide only one input song in this mode.")
 		os.Exit(1)
 	}
 
 	// emit song and sample data
-	songWriter, err := os.Create(OutputFilename)
+	var songWriter *os.File
+	var err error
+	if OutputFormat == "raw" {
+		songWriter, err = os.Create(OutputFilename)
+	} else {
+		songWriter, err = os.CreateTemp("", "vgmswan-*.bin")
+		if err == nil {
+			defer os.Remove(songWriter.Name())
+		}
+	}
 	if err != nil {
 		panic(err)
 	}
 	defer songWriter.Close()
 
 	position := uint32(0)
+	songTableEntrySize := bankPositionSize()
+	if len(data.SoundEffects) > 0 {
+		songTableEntrySize = bankPositionSize() + sfxTableInfoSize
+	}
 	// write empty song pointers for now
 	if !OneSongMode {
 		for i := 0; i < len(data.Songs); i++ {
-			songWriter.Write([]byte{0, 0, 0})
-			position += 3
+			songWriter.Write(make([]byte, songTableEntrySize))
+			position += uint32(songTableEntrySize)
 		}
 		if BuildTestROM {
-			songWriter.Write([]byte{0xFF, 0xFF, 0xFF})
-			position += 3
+			songWriter.Write(bytes.Repeat([]byte{0xFF}, songTableEntrySize))
+			position += uint32(songTableEntrySize)
 		}
 	}
-	if !DisablePCM {
-		// write all sample data
-		for i, sample := range data.Samples {
-			found := false
-			for j := 0; j < i; j++ {
-				otherSample := data.Samples[j]
-				if reflect.DeepEqual(sample.Data, otherSample.Data) {
-					sample.FilePosition = otherSample.FilePosition
-					found = true
-					break
-				}
+	// write empty sample table for now
+	sampleTablePosition := position
+	if len(data.SampleTable) > 0 {
+		songWriter.Write(make([]byte, len(data.SampleTable)*sampleTableEntrySize()))
+		position += uint32(len(data.SampleTable) * sampleTableEntrySize())
+		fmt.Printf("sample table: %d entries at offset %d\n", len(data.SampleTable), sampleTablePosition)
+	}
+	// write all sample data
+	for i, sample := range data.Samples {
+		found := false
+		for j := 0; j < i; j++ {
+			otherSample := data.Samples[j]
+			if reflect.DeepEqual(sample.Data, otherSample.Data) {
+				sample.FilePosition = otherSample.FilePosition
+				found = true
+				break
 			}
-			if !found {
-				sample.FilePosition = position
-				if sample.FilePosition+uint32(len(*sample.Data)) > 65536 {
-					panic(fmt.Errorf("sample data bank too big :-("))
-				}
-				songWriter.Write(*sample.Data)
-				position += uint32(len(*sample.Data))
+		}
+		if !found {
+			sample.FilePosition = position
+			if sample.FilePosition+uint32(len(*sample.Data)) > 65536 {
+				panic(fmt.Errorf("sample data bank too big :-("))
+			}
+			songWriter.Write(*sample.Data)
+			position += uint32(len(*sample.Data))
+		}
+	}
+	if len(data.SampleTable) > 0 {
+		// fill in sample table
+		songWriter.Seek(int64(sampleTablePosition), io.SeekStart)
+		for _, entry := range data.SampleTable {
+			pos := uint16(entry.Sample.FilePosition)
+			len := uint16(len(*entry.Sample.Data))
+			songWriter.Write([]byte{sampleControlByte(entry.Sample, false, false), uint8(pos), uint8(pos >> 8), uint8(len), uint8(len >> 8)})
+			if HyperVoice {
+				hvCtrl, hvChanCtrl := hyperVoiceControl(entry.Sample)
+				songWriter.Write([]byte{hvCtrl, hvChanCtrl})
 			}
 		}
+		songWriter.Seek(int64(position), io.SeekStart)
+	}
+	// write the global wavetable dictionary; sound effects do not use it, as
+	// the first bank of the song is mapped while they play
+	globalWaves := GlobalWavetables && len(data.SoundEffects) <= 0
+	waveDict := &waveDictionary{}
+	if globalWaves {
+		waves := sharedWaves(data.Songs)
+		if position+uint32(len(waves)*16) > 0x10000 {
+			panic(fmt.Errorf("wavetable dictionary does not fit in the first bank"))
+		}
+		if waveDict, err = writeWaveDictionary(songWriter, position, waves); err != nil {
+			panic(err)
+		}
+		filePos, _ := songWriter.Seek(0, io.SeekCurrent)
+		position = uint32(filePos)
 	}
 	// start writing song data
 	wavetableCache := make(map[[16]byte]uint16)
 	frameCache := make([]*CommandFrame, 0)
-	appendCmd := func(cmdBuffer []byte) {
+	// reserveCmd moves to the next bank if a command of the given size, plus
+	// a following 0xF7, does not fit in the current one
+	reserveCmd := func(size int) {
 		curBank := position >> 16
-		nextBank := (position + uint32(len(cmdBuffer)) + 1) >> 16
+		nextBank := (position + uint32(size) + 1) >> 16
 		if curBank != nextBank {
 			songWriter.Write([]byte{0xF7})
 			position += 1
@@ -585,6 +1042,9 @@ func main() {
 			wavetableCache = make(map[[16]byte]uint16)
 			frameCache = make([]*CommandFrame, 0)
 		}
+	}
+	appendCmd := func(cmdBuffer []byte) {
+		reserveCmd(len(cmdBuffer))
 		songWriter.Write(cmdBuffer)
 		filePos, _ := songWriter.Seek(0, io.SeekCurrent)
 		position = uint32(filePos)
@@ -593,8 +1053,13 @@ func main() {
 		song := data.Songs[i]
 		loopPosition := position
 		if !OneSongMode {
-			songWriter.Seek(int64(i*3), io.SeekStart)
-			writeBankPosition(songWriter, 0, position)
+			songWriter.Seek(int64(i*songTableEntrySize), io.SeekStart)
+			if err := writeBankPosition(songWriter, 0, position); err != nil {
+				panic(err)
+			}
+			if len(data.SoundEffects) > 0 {
+				songWriter.Write([]byte{data.SoundEffects[i].tableInfo()})
+			}
 		}
 		songWriter.Seek(int64(position), io.SeekStart)
 
@@ -615,79 +1080,89 @@ func main() {
 			}
 			if !found {
 				frame.Position = position
-				frameCache = append(frameCache, frame)
+				if frame.Callable() {
+					frameCache = append(frameCache, frame)
+				}
 				for _, cmdRaw := range frame.Commands {
-					cmdBuffer := []byte{}
-					switch cmd := cmdRaw.(type) {
-					case *CommandWritePort:
-						if len(cmd.Data) == 2 {
-							cmdBuffer = append(cmdBuffer, append([]byte{0x60 + cmd.Address}, cmd.Data...)...)
-						} else if len(cmd.Data) == 1 {
-							cmdBuffer = append(cmdBuffer, append([]byte{0x40 + cmd.Address}, cmd.Data...)...)
-						} else {
-							panic(fmt.Errorf("unknown port write data length %+v", cmd))
+					if key, ok := cacheableWave(cmdRaw); ok {
+						cmd := cmdRaw.(*CommandWriteMemory)
+						if pos, ok := waveDict.positions[key]; ok {
+							appendCmd(waveCommand(cmd.Address, pos))
+							continue
 						}
-					case *CommandWriteMemory:
-						if Emit0xFC && (cmd.Address&0x000F) == 0 && cmd.Address < 0x40 && len(cmd.Data) == 16 && (position&0xFFFF) < 0xFFE8 {
-							key := *(*[16]byte)(cmd.Data)
+						// with a global dictionary, 0xFC-0xFF commands can
+						// only point to the first bank
+						if !globalWaves && (position&0xFFFF) < 0xFFE8 {
 							if pos, ok := wavetableCache[key]; ok {
-								cmdBuffer = append(cmdBuffer, uint8(0xFC+(cmd.Address>>4)), uint8(pos), uint8(pos>>8))
-								break
-							} else {
-								wavetableCache[key] = uint16(position + 2)
+								appendCmd(waveCommand(cmd.Address, pos))
+								continue
 							}
+							wavetableCache[key] = uint16(position + 2)
 						}
-						cmdBuffer = append(cmdBuffer, append([]byte{uint8(cmd.Address), uint8(len(cmd.Data))}, cmd.Data...)...)
-					case *CommandWait:
-						if cmd.Length >= 256 {
-							cmdBuffer = append(cmdBuffer, 0xF9, uint8(cmd.Length), uint8(cmd.Length>>8))
-						} else if cmd.Length > 7 {
-							cmdBuffer = append(cmdBuffer, 0xF8, uint8(cmd.Length))
-						} else if cmd.Length > 0 {
-							cmdBuffer = append(cmdBuffer, 0xEF+uint8(cmd.Length))
-						}
-					case *CommandPlaySample:
-						if cmd.Sample == nil {
-							cmdBuffer = append(cmdBuffer, 0xFB, 0x00)
-						} else {
-							ctrl := uint8(0x80)
-							pos := uint16(cmd.Sample.FilePosition + uint32(cmd.CustomOffset))
-							len := uint16(len(*cmd.Sample.Data))
-							if cmd.CustomLength > 0 {
-								len = cmd.CustomLength
-							}
-							if cmd.Reverse {
-								pos += len - 1
-								ctrl |= 0x40
-							}
-							if cmd.Repeat {
-								ctrl |= 0x08
-							}
-							switch cmd.Sample.Frequency {
-							case 4000:
-								break
-							case 6000:
-								ctrl |= 0x01
-							case 12000:
-								ctrl |= 0x02
-							case 24000:
-								ctrl |= 0x03
-							default:
-								panic(fmt.Errorf("unknown frequency %d", cmd.Sample.Frequency))
-							}
-							cmdBuffer = append(cmdBuffer, 0xFB, ctrl, uint8(pos), uint8(pos>>8), uint8(len), uint8(len>>8))
-						}
-					default:
-						panic(fmt.Errorf("unknown command type %+v", cmd))
 					}
-					appendCmd(cmdBuffer)
+					appendCmd(encodeCommand(cmdRaw))
 				}
 			}
 		}
-		songWriter.Write([]byte{0xFA})
-		writeBankPosition(songWriter, position, loopPosition)
-		filePos, _ := songWriter.Seek(0, io.SeekCurrent)
-		position = uint32(filePos)
+		// loop commands hold a bank delta relative to their own bank, so
+		// reserve their space before encoding it
+		if song.LoopCount == LoopForever {
+			reserveCmd(1 + bankPositionSize())
+			songWriter.Write([]byte{0xFA})
+			if err := writeBankPosition(songWriter, position, loopPosition); err != nil {
+				panic(err)
+			}
+			filePos, _ := songWriter.Seek(0, io.SeekCurrent)
+			position = uint32(filePos)
+		} else {
+			if song.LoopCount > 0 {
+				reserveCmd(2 + bankPositionSize())
+				songWriter.Write([]byte{0xEB, uint8(song.LoopCount)})
+				if err := writeBankPosition(songWriter, position, loopPosition); err != nil {
+					panic(err)
+				}
+				filePos, _ := songWriter.Seek(0, io.SeekCurrent)
+				position = uint32(filePos)
+			}
+			appendCmd([]byte{0xED})
+		}
+	}
+
+	// write symbol headers
+	symbols := BankSymbols{
+		SampleTableOffset: sampleTablePosition,
+		Size:              position,
+	}
+	for _, sfx := range data.SoundEffects {
+		symbols.SoundEffects = append(symbols.SoundEffects, sfx.Name)
+	}
+	if len(data.SoundEffects) <= 0 {
+		for _, song := range data.Songs {
+			symbols.Songs = append(symbols.Songs, song.Name)
+		}
+	}
+	for _, entry := range data.SampleTable {
+		symbols.Samples = append(symbols.Samples, entry.Name)
+	}
+	if err := symbols.WriteHeaders(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if OutputFormat != "raw" {
+		bankData := make([]byte, position)
+		songWriter.Seek(0, io.SeekStart)
+		if _, err := io.ReadFull(songWriter, bankData); err != nil {
+			panic(err)
+		}
+		if OutputFormat == "c" {
+			err = WriteCSource(OutputFilename, bankData)
+		} else {
+			err = WriteELFObject(OutputFilename, bankData)
+		}
+		if err != nil {
+			panic(err)
+		}
 	}
 
 	if BuildTestROM {
@@ -700,11 +1175,14 @@ func main() {
 		for _, d := range fileData {
 			checksum += uint16(d)
 		}
-		fileTargetSize := 131072
-		for fileTargetSize < (len(engineBin) + len(fileData)) {
-			fileTargetSize *= 2
+		fileTargetSize, romSizeValue, err := romTargetSize(len(engineBin) + len(fileData))
+		if err != nil {
+			panic(err)
+		}
+		engineBin[len(engineBin)-romFooterSize+romFooterROMSize] = romSizeValue
+		if err := ROMHeader.Apply(engineBin); err != nil {
+			panic(err)
 		}
-		engineBin[len(engineBin)-6] = romSizeToHeaderValue[fileTargetSize]
 
 		// calculate checksum remainder
 		for i := 0; i < len(engineBin)-2; i++ {
@@ -713,8 +1191,8 @@ func main() {
 		padByte := []byte{0xFF}
 		padByteCount := fileTargetSize - len(engineBin) - len(fileData)
 		checksum += uint16(uint64(padByteCount) * uint64(padByte[0]))
-		engineBin[len(engineBin)-2] = uint8(checksum)
-		engineBin[len(engineBin)-1] = uint8(checksum >> 8)
+		engineBin[len(engineBin)-romFooterSize+romFooterChecksum] = uint8(checksum)
+		engineBin[len(engineBin)-romFooterSize+romFooterChecksum+1] = uint8(checksum >> 8)
 
 		for i := 0; i < padByteCount; i++ {
 			songWriter.Write(padByte)
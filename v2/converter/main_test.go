@@ -0,0 +1,207 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// WonderSwan VGM header offsets and clock, for testVGM.
+const (
+	testVGMClockWonderSwan  = 0xC0
+	testVGMWonderSwanClock  = 3072000
+	testVGMCommandPortWrite = 0xBC
+)
+
+// testVGM builds a version 1.71 VGM file with the given header values and
+// commands, looping to commands[loop] unless loop is negative.
+func testVGM(header map[int]uint32, commands []byte, loop int) *bytes.Reader {
+	data := make([]byte, 0x100, 0x100+len(commands)+1)
+	copy(data, "Vgm ")
+	binary.LittleEndian.PutUint32(data[0x08:], 0x171)
+	binary.LittleEndian.PutUint32(data[0x34:], 0x100-0x34)
+	for offset, value := range header {
+		binary.LittleEndian.PutUint32(data[offset:], value)
+	}
+	if loop >= 0 {
+		binary.LittleEndian.PutUint32(data[0x1C:], uint32(0x100+loop-0x1C))
+	}
+	data = append(data, commands...)
+	data = append(data, 0x66)
+	binary.LittleEndian.PutUint32(data[0x04:], uint32(len(data)-4))
+	return bytes.NewReader(data)
+}
+
+// testWonderSwanVGM builds a WonderSwan VGM file from commands.
+func testWonderSwanVGM(commands []byte, loop int) *bytes.Reader {
+	return testVGM(map[int]uint32{testVGMClockWonderSwan: testVGMWonderSwanClock}, commands, loop)
+}
+
+// vgmWait returns a VGM wait command for the given amount of samples.
+func vgmWait(samples uint16) []byte {
+	return []byte{0x61, uint8(samples), uint8(samples >> 8)}
+}
+
+// vgmPort returns a VGM WonderSwan port write command.
+func vgmPort(addr uint8, value uint8) []byte {
+	return []byte{testVGMCommandPortWrite, addr, value}
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestParseVGMMarkers(t *testing.T) {
+	defer func(v bool, m bool) { HBlankTiming, VGMMarkers = v, m }(HBlankTiming, VGMMarkers)
+	HBlankTiming = true
+
+	tests := []struct {
+		name        string
+		vgmMarkers  bool
+		commands    []byte
+		markers     []Marker
+		wantMarkers []uint8
+		wantWaits   []uint32
+		wantDropped int
+	}{
+		{
+			"sidecar markers split waits",
+			false,
+			concat(vgmPort(0x10, 0x01), vgmWait(4410)),
+			[]Marker{{1000, 1}, {2000, 2}},
+			[]uint8{1, 2},
+			// 4410 samples are 1200 lines, however they are split
+			[]uint32{273, 272, 655},
+			0,
+		},
+		{
+			"many markers do not add up rounding errors",
+			false,
+			concat(vgmPort(0x10, 0x01), vgmWait(4410)),
+			[]Marker{{1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 5}, {6, 6}},
+			[]uint8{1, 2, 3, 4, 5, 6},
+			// pieces shorter than a line are merged into later waits
+			[]uint32{1, 1, 1198},
+			0,
+		},
+		{
+			"markers past the end are dropped",
+			false,
+			concat(vgmPort(0x10, 0x01), vgmWait(441)),
+			[]Marker{{100, 1}, {50000, 2}, {60000, 3}},
+			[]uint8{1},
+			[]uint32{28, 92},
+			2,
+		},
+		{
+			"embedded markers are skipped by default",
+			false,
+			concat(vgmPort(0x10, 0x01), []byte{vgmMarkerCommand, 7}, vgmWait(441)),
+			nil,
+			nil,
+			[]uint32{120},
+			0,
+		},
+		{
+			"embedded markers are read with -vgm-markers",
+			true,
+			concat(vgmPort(0x10, 0x01), []byte{vgmMarkerCommand, 7}, vgmWait(441)),
+			nil,
+			[]uint8{7},
+			[]uint32{120},
+			0,
+		},
+	}
+	for _, tt := range tests {
+		VGMMarkers = tt.vgmMarkers
+		song, err := parseVGM(testWonderSwanVGM(tt.commands, -1), tt.markers)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var markers []uint8
+		var waits []uint32
+		for _, frame := range song.Commands {
+			for _, cmdRaw := range frame.Commands {
+				switch cmd := cmdRaw.(type) {
+				case *CommandMarker:
+					markers = append(markers, cmd.ID)
+				case *CommandWait:
+					waits = append(waits, cmd.Length)
+				}
+			}
+		}
+		if string(markers) != string(tt.wantMarkers) {
+			t.Errorf("%s: markers %v, want %v", tt.name, markers, tt.wantMarkers)
+		}
+		if len(waits) != len(tt.wantWaits) {
+			t.Errorf("%s: waits %v, want %v", tt.name, waits, tt.wantWaits)
+		} else {
+			for i := range waits {
+				if waits[i] != tt.wantWaits[i] {
+					t.Errorf("%s: waits %v, want %v", tt.name, waits, tt.wantWaits)
+					break
+				}
+			}
+		}
+		if song.DroppedMarkers != tt.wantDropped {
+			t.Errorf("%s: %d markers dropped, want %d", tt.name, song.DroppedMarkers, tt.wantDropped)
+		}
+	}
+}
+
+func TestWriteBankPosition(t *testing.T) {
+	oneSong, mapper2003 := OneSongMode, Mapper2003Banks
+	t.Cleanup(func() {
+		OneSongMode, Mapper2003Banks = oneSong, mapper2003
+	})
+
+	tests := []struct {
+		oneSong    bool
+		mapper2003 bool
+		current    uint32
+		written    uint32
+		want       []byte
+		wantErr    bool
+	}{
+		{true, false, 0x012345, 0x056789, []byte{0x89, 0x67}, false},
+		{false, false, 0x012345, 0x016789, []byte{0x89, 0x67, 0x00}, false},
+		{false, false, 0x012345, 0x036789, []byte{0x89, 0x67, 0x02}, false},
+		// bank deltas wrap around
+		{false, false, 0x030000, 0x011234, []byte{0x34, 0x12, 0xFE}, false},
+		{false, false, 0x000000, 0x1000000, nil, true},
+		{false, false, 0x1000000, 0x000000, nil, true},
+		{false, true, 0x012345, 0x1236789, []byte{0x89, 0x67, 0x22, 0x01}, false},
+		{false, true, 0x030000, 0x011234, []byte{0x34, 0x12, 0xFE, 0xFF}, false},
+	}
+	for _, tt := range tests {
+		OneSongMode, Mapper2003Banks = tt.oneSong, tt.mapper2003
+		var buf bytes.Buffer
+		err := writeBankPosition(&buf, tt.current, tt.written)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%06X -> %06X: error %v, want error %v", tt.current, tt.written, err, tt.wantErr)
+		} else if !tt.wantErr && !bytes.Equal(buf.Bytes(), tt.want) {
+			t.Errorf("%06X -> %06X: got % X, want % X", tt.current, tt.written, buf.Bytes(), tt.want)
+		}
+	}
+}
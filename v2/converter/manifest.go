@@ -0,0 +1,406 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Manifest describes a complete bank: its songs, samples, sound effects and
+// conversion options. Relative paths are resolved against the manifest's
+// directory.
+type Manifest struct {
+	Output       string                `json:"output"`
+	Options      ManifestOptions       `json:"options"`
+	ROM          ManifestROM           `json:"rom"`
+	Songs        []ManifestSong        `json:"songs"`
+	Samples      []ManifestSample      `json:"samples"`
+	SoundEffects []ManifestSoundEffect `json:"sfx"`
+	directory    string
+}
+
+type ManifestOptions struct {
+	DisablePCM         *bool    `json:"disablePCM"`
+	DisableResampling  *bool    `json:"disableResampling"`
+	Enable24KHzSamples *bool    `json:"enable24KHzSamples"`
+	HBlankTiming       *bool    `json:"hblankTiming"`
+	OneSong            *bool    `json:"oneSong"`
+	Mapper2003         *bool    `json:"mapper2003"`
+	GlobalWavetables   *bool    `json:"globalWavetables"`
+	WaveBase           *string  `json:"waveBase"`
+	HyperVoice         *bool    `json:"hyperVoice"`
+	HyperVoiceStereo   *bool    `json:"hyperVoiceStereo"`
+	HyperVoiceSigned   *bool    `json:"hyperVoiceSigned"`
+	Mute               *string  `json:"mute"`
+	Volume             *float64 `json:"volume"`
+	FadeOut            *float64 `json:"fadeOut"`
+	HuC6280Channels    *string  `json:"huc6280Channels"`
+	AYEnvelopeRate     *float64 `json:"ayEnvelopeRate"`
+	Instruments        *string  `json:"instruments"`
+	Stereo             *string  `json:"stereo"`
+	Pan                *string  `json:"pan"`
+	VGMMarkers         *bool    `json:"vgmMarkers"`
+}
+
+type ManifestROM struct {
+	Test        *bool   `json:"test"`
+	PublisherID *uint8  `json:"publisherId"`
+	GameID      *uint8  `json:"gameId"`
+	Revision    *uint8  `json:"revision"`
+	Color       *bool   `json:"color"`
+	Orientation *string `json:"orientation"`
+	SaveType    *string `json:"saveType"`
+	RTC         *bool   `json:"rtc"`
+	Mapper      *string `json:"mapper"`
+	Engine      *string `json:"engine"`
+}
+
+// ManifestLoop is a loop count, given either as a number or as one of the
+// strings "forever" and "none".
+type ManifestLoop string
+
+func (l *ManifestLoop) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case string:
+		*l = ManifestLoop(v)
+	case float64:
+		*l = ManifestLoop(strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		return fmt.Errorf("invalid loop count %s", string(data))
+	}
+	return nil
+}
+
+type ManifestSong struct {
+	ID          *int         `json:"id"`
+	Name        string       `json:"name"`
+	File        string       `json:"file"`
+	Loop        ManifestLoop `json:"loop"`
+	Markers     string       `json:"markers"`
+	Instruments string       `json:"instruments"`
+	Mute        *string      `json:"mute"`
+	Volume      *float64     `json:"volume"`
+	Stereo      *string      `json:"stereo"`
+	Pan         *string      `json:"pan"`
+	FadeOut     *float64     `json:"fadeOut"`
+	Tempo       *float64     `json:"tempo"`
+}
+
+type ManifestSample struct {
+	Name string   `json:"name"`
+	File string   `json:"file"`
+	Trim []int    `json:"trim"`
+	Gain *float64 `json:"gain"`
+	Rate uint32   `json:"rate"`
+}
+
+type ManifestSoundEffect struct {
+	Name     string `json:"name"`
+	File     string `json:"file"`
+	Priority uint8  `json:"priority"`
+	Channels string `json:"channels"`
+}
+
+// ReadManifest reads a JSON manifest file.
+func ReadManifest(filename string) (*Manifest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	manifest.directory = filepath.Dir(filename)
+	return &manifest, nil
+}
+
+func (m *Manifest) path(filename string) string {
+	if len(filename) == 0 || filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(m.directory, filename)
+}
+
+func setIfPresent[T any](target *T, value *T) {
+	if value != nil {
+		*target = *value
+	}
+}
+
+// Apply applies the manifest's options and adds its samples and sound
+// effects to the global lists, returning its songs in ID order. Options set
+// by the given command line flags are kept.
+func (m *Manifest) Apply(flagsSet map[string]bool) ([]*SongFile, error) {
+	// option returns whether a manifest option should be applied, as it is
+	// present and its command line flag was not set
+	option := func(present bool, flagName string) bool {
+		return present && !flagsSet[flagName]
+	}
+	setOption := func(target *bool, value *bool, flagName string) {
+		if option(value != nil, flagName) {
+			*target = *value
+		}
+	}
+	setOption(&DisablePCM, m.Options.DisablePCM, "disable-pcm")
+	setOption(&DisableResampling, m.Options.DisableResampling, "disable-resampling")
+	setOption(&Enable24KHzSamples, m.Options.Enable24KHzSamples, "enable-24khz-samples")
+	setOption(&HBlankTiming, m.Options.HBlankTiming, "hblank-timing")
+	setOption(&OneSongMode, m.Options.OneSong, "one-song")
+	setOption(&Mapper2003Banks, m.Options.Mapper2003, "mapper-2003")
+	setOption(&GlobalWavetables, m.Options.GlobalWavetables, "global-wavetables")
+	setOption(&HyperVoice, m.Options.HyperVoice, "hypervoice")
+	setOption(&HyperVoiceStereo, m.Options.HyperVoiceStereo, "hypervoice-stereo")
+	setOption(&HyperVoiceSigned, m.Options.HyperVoiceSigned, "hypervoice-signed")
+	setOption(&VGMMarkers, m.Options.VGMMarkers, "vgm-markers")
+	if option(m.Options.Volume != nil, "volume") {
+		if err := checkVolumeScale(*m.Options.Volume); err != nil {
+			return nil, err
+		}
+		VolumeScale = *m.Options.Volume
+	}
+	if option(m.Options.FadeOut != nil, "fade-out") {
+		FadeOutSeconds = *m.Options.FadeOut
+	}
+	if option(m.Options.AYEnvelopeRate != nil, "ay-envelope-rate") {
+		AYEnvelopeRate = *m.Options.AYEnvelopeRate
+	}
+	if option(m.Options.Instruments != nil, "instruments") {
+		InstrumentFilename = m.path(*m.Options.Instruments)
+	}
+	if option(m.Options.Mute != nil, "mute") {
+		channels, ok := parseChannelList(*m.Options.Mute)
+		if !ok {
+			return nil, fmt.Errorf("invalid channel list %q", *m.Options.Mute)
+		}
+		MutedChannels = channels
+	}
+	if option(m.Options.WaveBase != nil, "wave-base") {
+		base, err := parseWaveBase(*m.Options.WaveBase)
+		if err != nil {
+			return nil, err
+		}
+		WaveBase = base
+	}
+	if option(m.Options.Stereo != nil, "stereo") {
+		mode, err := parseStereoMode(*m.Options.Stereo)
+		if err != nil {
+			return nil, err
+		}
+		StereoMode = mode
+	}
+	if option(m.Options.Pan != nil, "pan") {
+		pan, err := parsePanOffsets(*m.Options.Pan)
+		if err != nil {
+			return nil, err
+		}
+		PanOffsets = pan
+	}
+	if option(m.Options.HuC6280Channels != nil, "huc6280-channels") {
+		channels, err := parseHuC6280Channels(*m.Options.HuC6280Channels)
+		if err != nil {
+			return nil, err
+		}
+		HuC6280Channels = channels
+	}
+	setOption(&BuildTestROM, m.ROM.Test, "t")
+	if option(m.ROM.PublisherID != nil, "rom-publisher") {
+		ROMHeader.PublisherID = m.ROM.PublisherID
+	}
+	if option(m.ROM.GameID != nil, "rom-game-id") {
+		ROMHeader.GameID = m.ROM.GameID
+	}
+	if option(m.ROM.Revision != nil, "rom-revision") {
+		ROMHeader.Revision = m.ROM.Revision
+	}
+	if option(m.ROM.Color != nil, "rom-color") {
+		ROMHeader.Color = m.ROM.Color
+	}
+	if option(m.ROM.RTC != nil, "rom-rtc") {
+		ROMHeader.RTC = m.ROM.RTC
+	}
+	if option(m.ROM.Orientation != nil, "rom-orientation") {
+		v, err := parseOrientation(*m.ROM.Orientation)
+		if err != nil {
+			return nil, err
+		}
+		ROMHeader.Vertical = &v
+	}
+	if option(m.ROM.SaveType != nil, "rom-save-type") {
+		v, err := parseSaveType(*m.ROM.SaveType)
+		if err != nil {
+			return nil, err
+		}
+		ROMHeader.SaveType = &v
+	}
+	if option(m.ROM.Mapper != nil, "rom-mapper") {
+		v, err := parseMapper(*m.ROM.Mapper)
+		if err != nil {
+			return nil, err
+		}
+		ROMHeader.Mapper = &v
+	}
+	if option(m.ROM.Engine != nil, "engine") {
+		EngineFilename = m.path(*m.ROM.Engine)
+	}
+	if option(len(m.Output) > 0, "o") {
+		OutputFilename = m.path(m.Output)
+	}
+
+	for _, s := range m.Samples {
+		f := SampleFile{
+			Name:      s.Name,
+			Filename:  m.path(s.File),
+			Gain:      1.0,
+			Frequency: s.Rate,
+		}
+		if len(f.Name) <= 0 {
+			f.Name = defaultName(f.Filename)
+		}
+		setIfPresent(&f.Gain, s.Gain)
+		if len(s.Trim) > 2 {
+			return nil, fmt.Errorf("%s: invalid trim %v", f.Filename, s.Trim)
+		}
+		for _, v := range s.Trim {
+			if v < 0 {
+				return nil, fmt.Errorf("%s: invalid trim %v", f.Filename, s.Trim)
+			}
+		}
+		if len(s.Trim) > 0 {
+			f.TrimStart = s.Trim[0]
+		}
+		if len(s.Trim) > 1 {
+			f.TrimEnd = s.Trim[1]
+		}
+		SampleFiles = append(SampleFiles, &f)
+	}
+
+	for _, s := range m.SoundEffects {
+		f := SoundEffectFile{
+			Name:     s.Name,
+			Filename: m.path(s.File),
+			Priority: s.Priority,
+		}
+		if len(f.Name) <= 0 {
+			f.Name = defaultName(f.Filename)
+		}
+		if f.Priority > 15 {
+			return nil, fmt.Errorf("%s: invalid priority %d", f.Filename, f.Priority)
+		}
+		if len(s.Channels) > 0 {
+			channels, ok := parseChannelList(s.Channels)
+			if !ok || channels == 0 {
+				return nil, fmt.Errorf("%s: invalid channel list %q", f.Filename, s.Channels)
+			}
+			f.Channels = channels
+		}
+		SoundEffectFiles = append(SoundEffectFiles, &f)
+	}
+
+	songs := make([]*SongFile, len(m.Songs))
+	ids := make([]int, len(m.Songs))
+	usedIds := make(map[int]bool)
+	for i, s := range m.Songs {
+		f := NewSongFile(m.path(s.File))
+		if len(s.Name) > 0 {
+			f.Name = s.Name
+		}
+		if len(s.Loop) > 0 {
+			v, err := parseLoopCount(string(s.Loop))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Filename, err)
+			}
+			f.LoopCount = &v
+		}
+		f.MarkerFilename = m.path(s.Markers)
+		if len(s.Instruments) > 0 {
+			f.InstrumentFilename = m.path(s.Instruments)
+		}
+		if s.Mute != nil {
+			channels, ok := parseChannelList(*s.Mute)
+			if !ok {
+				return nil, fmt.Errorf("%s: invalid channel list %q", f.Filename, *s.Mute)
+			}
+			f.Mute = channels
+		}
+		if s.Volume != nil {
+			if err := checkVolumeScale(*s.Volume); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Filename, err)
+			}
+			f.Volume = *s.Volume
+		}
+		if s.Stereo != nil {
+			mode, err := parseStereoMode(*s.Stereo)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Filename, err)
+			}
+			f.Stereo = mode
+		}
+		if s.Pan != nil {
+			pan, err := parsePanOffsets(*s.Pan)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Filename, err)
+			}
+			f.Pan = pan
+		}
+		setIfPresent(&f.FadeOut, s.FadeOut)
+		setIfPresent(&f.Tempo, s.Tempo)
+
+		ids[i] = i
+		if s.ID != nil {
+			ids[i] = *s.ID
+		}
+		if usedIds[ids[i]] {
+			if s.ID == nil {
+				return nil, fmt.Errorf("%s: song ID %d, defaulted from its position, is already used; give it an explicit ID", f.Filename, ids[i])
+			}
+			return nil, fmt.Errorf("%s: duplicate song ID %d", f.Filename, ids[i])
+		}
+		usedIds[ids[i]] = true
+		songs[i] = f
+	}
+
+	// order songs by ID; IDs must form a contiguous range starting at zero
+	order := make([]int, len(songs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return ids[order[i]] < ids[order[j]]
+	})
+	result := make([]*SongFile, len(songs))
+	for i, idx := range order {
+		if ids[idx] != i {
+			return nil, fmt.Errorf("song IDs must be contiguous, starting at 0; missing ID %d", i)
+		}
+		result[i] = songs[idx]
+	}
+	return result, nil
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// keepManifestGlobals restores the options changed by Manifest.Apply when
+// the test finishes.
+func keepManifestGlobals(t *testing.T) {
+	disablePCM, disableResampling, enable24KHz := DisablePCM, DisableResampling, Enable24KHzSamples
+	hblank, oneSong, mapper2003, globalWaves, waveBase := HBlankTiming, OneSongMode, Mapper2003Banks, GlobalWavetables, WaveBase
+	hyperVoice, hyperVoiceStereo, hyperVoiceSigned := HyperVoice, HyperVoiceStereo, HyperVoiceSigned
+	markers, volume, fadeOut, muted := VGMMarkers, VolumeScale, FadeOutSeconds, MutedChannels
+	stereo, pan, hucChannels, ayRate := StereoMode, PanOffsets, HuC6280Channels, AYEnvelopeRate
+	instruments, testROM, header, engine, output := InstrumentFilename, BuildTestROM, ROMHeader, EngineFilename, OutputFilename
+	samples, sfx := SampleFiles, SoundEffectFiles
+	t.Cleanup(func() {
+		DisablePCM, DisableResampling, Enable24KHzSamples = disablePCM, disableResampling, enable24KHz
+		HBlankTiming, OneSongMode, Mapper2003Banks, GlobalWavetables, WaveBase = hblank, oneSong, mapper2003, globalWaves, waveBase
+		HyperVoice, HyperVoiceStereo, HyperVoiceSigned = hyperVoice, hyperVoiceStereo, hyperVoiceSigned
+		VGMMarkers, VolumeScale, FadeOutSeconds, MutedChannels = markers, volume, fadeOut, muted
+		StereoMode, PanOffsets, HuC6280Channels, AYEnvelopeRate = stereo, pan, hucChannels, ayRate
+		InstrumentFilename, BuildTestROM, ROMHeader, EngineFilename, OutputFilename = instruments, testROM, header, engine, output
+		SampleFiles, SoundEffectFiles = samples, sfx
+	})
+}
+
+// readTestManifest writes a manifest to a temporary directory and reads it.
+func readTestManifest(t *testing.T, data string) *Manifest {
+	filename := filepath.Join(t.TempDir(), "manifest.json")
+	if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ReadManifest(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func TestReadManifest(t *testing.T) {
+	manifest := readTestManifest(t, `{
+		"output": "out.bin",
+		"songs": [
+			{"file": "a.vgm", "loop": 2},
+			{"file": "b.vgm", "loop": "forever"},
+			{"file": "/abs/c.vgm"}
+		]
+	}`)
+	if got := []ManifestLoop{manifest.Songs[0].Loop, manifest.Songs[1].Loop, manifest.Songs[2].Loop}; got[0] != "2" || got[1] != "forever" || got[2] != "" {
+		t.Errorf("loops: got %q", got)
+	}
+	if got, want := manifest.path("a.vgm"), filepath.Join(manifest.directory, "a.vgm"); got != want {
+		t.Errorf("relative path: got %q, want %q", got, want)
+	}
+	if got := manifest.path("/abs/c.vgm"); got != "/abs/c.vgm" {
+		t.Errorf("absolute path: got %q", got)
+	}
+	if got := manifest.path(""); got != "" {
+		t.Errorf("empty path: got %q", got)
+	}
+}
+
+func TestReadManifestErrors(t *testing.T) {
+	for _, data := range []string{
+		`{"songs": [`,
+		`{"songs": [{"file": "a.vgm", "loop": true}]}`,
+		`{"sfx": [{"file": "a.vgm", "priority": 256}]}`,
+	} {
+		filename := filepath.Join(t.TempDir(), "manifest.json")
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadManifest(filename); err == nil {
+			t.Errorf("%s: expected an error", data)
+		}
+	}
+	if _, err := ReadManifest(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing file: expected an error")
+	}
+}
+
+func TestManifestApplyOptions(t *testing.T) {
+	keepManifestGlobals(t)
+	VolumeScale = 1.0
+	FadeOutSeconds = 0
+	MutedChannels = 0
+	SampleFiles = nil
+	SoundEffectFiles = nil
+	ROMHeader = ROMHeaderOptions{}
+
+	manifest := readTestManifest(t, `{
+		"output": "out.bin",
+		"options": {"disablePCM": true, "volume": 0.5, "fadeOut": 3, "mute": "4", "waveBase": "0x100"},
+		"rom": {"gameId": 7, "orientation": "vertical", "engine": "engine.bin"},
+		"samples": [{"file": "hit.wav", "trim": [10, 20], "gain": 2}],
+		"sfx": [{"file": "jump.vgm", "priority": 3, "channels": "12"}]
+	}`)
+	// flags given on the command line win over the manifest
+	VolumeScale = 0.75
+	if _, err := manifest.Apply(map[string]bool{"volume": true}); err != nil {
+		t.Fatal(err)
+	}
+	if !DisablePCM || FadeOutSeconds != 3 || MutedChannels != 0x08 || WaveBase != 0x100 {
+		t.Errorf("options: got PCM disabled %v, fade out %v, muted %X, wave base %X", DisablePCM, FadeOutSeconds, MutedChannels, WaveBase)
+	}
+	if VolumeScale != 0.75 {
+		t.Errorf("volume set on the command line: got %v, want 0.75", VolumeScale)
+	}
+	if ROMHeader.GameID == nil || *ROMHeader.GameID != 7 || ROMHeader.Vertical == nil || !*ROMHeader.Vertical {
+		t.Errorf("ROM header: got %+v", ROMHeader)
+	}
+	if want := manifest.path("engine.bin"); EngineFilename != want {
+		t.Errorf("engine: got %q, want %q", EngineFilename, want)
+	}
+	if want := manifest.path("out.bin"); OutputFilename != want {
+		t.Errorf("output: got %q, want %q", OutputFilename, want)
+	}
+	if len(SampleFiles) != 1 {
+		t.Fatalf("samples: got %d, want 1", len(SampleFiles))
+	}
+	if s := SampleFiles[0]; s.Name != "hit" || s.TrimStart != 10 || s.TrimEnd != 20 || s.Gain != 2 {
+		t.Errorf("sample: got %+v", s)
+	}
+	if len(SoundEffectFiles) != 1 {
+		t.Fatalf("sound effects: got %d, want 1", len(SoundEffectFiles))
+	}
+	if s := SoundEffectFiles[0]; s.Name != "jump" || s.Priority != 3 || s.Channels != 0x03 {
+		t.Errorf("sound effect: got %+v", s)
+	}
+}
+
+func TestManifestApplySongs(t *testing.T) {
+	keepManifestGlobals(t)
+	VolumeScale = 1.0
+	MutedChannels = 0
+
+	manifest := readTestManifest(t, `{
+		"songs": [
+			{"id": 2, "file": "c.vgm", "loop": "none"},
+			{"id": 0, "file": "a.vgm", "name": "title", "volume": 0.5, "tempo": 1.5},
+			{"id": 1, "file": "b.vgm", "mute": "13", "loop": 3}
+		]
+	}`)
+	songs, err := manifest.Apply(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(songs))
+	for i, s := range songs {
+		names[i] = s.Name
+	}
+	if len(songs) != 3 || songs[0].Name != "title" || songs[1].Filename != manifest.path("b.vgm") || songs[2].Filename != manifest.path("c.vgm") {
+		t.Fatalf("song order: got %q", names)
+	}
+	if songs[0].Volume != 0.5 || songs[0].Tempo != 1.5 || songs[0].LoopCount != nil {
+		t.Errorf("song 0: got %+v", songs[0])
+	}
+	if songs[1].Mute != 0x05 || songs[1].LoopCount == nil || *songs[1].LoopCount != 3 {
+		t.Errorf("song 1: got %+v", songs[1])
+	}
+	if songs[2].LoopCount == nil || *songs[2].LoopCount != 0 || songs[2].Volume != 1.0 {
+		t.Errorf("song 2: got %+v", songs[2])
+	}
+}
+
+func TestManifestApplyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"duplicate ID", `{"songs": [{"id": 0, "file": "a.vgm"}, {"id": 0, "file": "b.vgm"}]}`},
+		{"default ID collision", `{"songs": [{"id": 1, "file": "a.vgm"}, {"file": "b.vgm"}]}`},
+		{"missing ID", `{"songs": [{"id": 0, "file": "a.vgm"}, {"id": 2, "file": "b.vgm"}]}`},
+		{"negative ID", `{"songs": [{"id": -1, "file": "a.vgm"}]}`},
+		{"invalid loop", `{"songs": [{"file": "a.vgm", "loop": "twice"}]}`},
+		{"invalid song volume", `{"songs": [{"file": "a.vgm", "volume": -1}]}`},
+		{"invalid song mute", `{"songs": [{"file": "a.vgm", "mute": "5"}]}`},
+		{"invalid song stereo", `{"songs": [{"file": "a.vgm", "stereo": "wide"}]}`},
+		{"invalid volume", `{"options": {"volume": -1}}`},
+		{"invalid mute", `{"options": {"mute": "0"}}`},
+		{"invalid wave base", `{"options": {"waveBase": "0x123"}}`},
+		{"invalid pan", `{"options": {"pan": "1:2"}}`},
+		{"invalid orientation", `{"rom": {"orientation": "diagonal"}}`},
+		{"invalid mapper", `{"rom": {"mapper": "2002"}}`},
+		{"negative trim", `{"samples": [{"file": "a.wav", "trim": [-1]}]}`},
+		{"long trim", `{"samples": [{"file": "a.wav", "trim": [1, 2, 3]}]}`},
+		{"invalid priority", `{"sfx": [{"file": "a.vgm", "priority": 16}]}`},
+		{"invalid channels", `{"sfx": [{"file": "a.vgm", "channels": "5"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepManifestGlobals(t)
+			manifest := readTestManifest(t, tt.data)
+			if _, err := manifest.Apply(nil); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/asiekierka/vgmswan/v2/converter/vgm"
+)
+
+// VGM command (reserved by the specification) used to embed markers; only
+// read as such with -vgm-markers, and skipped otherwise.
+const vgmMarkerCommand = 0x3E
+
+// Read markers embedded in VGM files with vgmMarkerCommand.
+var VGMMarkers = false
+
+type Marker struct {
+	Position uint32
+	ID       uint8
+}
+
+// ReadMarkerFile reads a marker sidecar file. Each line contains a position,
+// either in VGM samples or in seconds with an "s" suffix, followed by the
+// marker ID (0-255). Text after a "#" is ignored.
+func ReadMarkerFile(filename string) ([]Marker, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var markers []Marker
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected position and marker ID", filename, line)
+		}
+
+		var marker Marker
+		if strings.HasSuffix(fields[0], "s") {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(fields[0], "s"), 64)
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("%s:%d: invalid position %q", filename, line, fields[0])
+			}
+			marker.Position = uint32(v * vgm.VGM_SAMPLES_PER_SECOND)
+		} else {
+			v, err := strconv.ParseUint(fields[0], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid position %q", filename, line, fields[0])
+			}
+			marker.Position = uint32(v)
+		}
+		id, err := strconv.ParseUint(fields[1], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid marker ID %q", filename, line, fields[1])
+		}
+		marker.ID = uint8(id)
+		markers = append(markers, marker)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(markers, func(i, j int) bool {
+		return markers[i].Position < markers[j].Position
+	})
+	return markers, nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadMarkerFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []Marker
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"samples", "44100 1\n0 2\n", []Marker{{0, 2}, {44100, 1}}, false},
+		{"seconds", "1.5s 3\n0.5s 4\n", []Marker{{22050, 4}, {66150, 3}}, false},
+		{"comments and blank lines", "# intro\n\n100 5 # drums\n", []Marker{{100, 5}}, false},
+		{"stable order", "10 2\n10 1\n", []Marker{{10, 2}, {10, 1}}, false},
+		{"missing ID", "100\n", nil, true},
+		{"extra field", "100 1 2\n", nil, true},
+		{"negative seconds", "-1s 1\n", nil, true},
+		{"negative samples", "-1 1\n", nil, true},
+		{"ID out of range", "100 256\n", nil, true},
+		{"invalid position", "soon 1\n", nil, true},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		filename := filepath.Join(dir, "markers.txt")
+		if err := os.WriteFile(filename, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadMarkerFile(filename)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestReadMarkerFileMissing(t *testing.T) {
+	if _, err := ReadMarkerFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Errorf("expected an error")
+	}
+}
@@ -0,0 +1,548 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/asiekierka/vgmswan/v2/converter/vgm"
+)
+
+const (
+	midiNoteOff         = 0x80
+	midiNoteOn          = 0x90
+	midiControlChange   = 0xB0
+	midiProgramChange   = 0xC0
+	midiChannelPressure = 0xD0
+	midiPitchBend       = 0xE0
+	midiSysEx           = 0xF0
+	midiSysExEscape     = 0xF7
+	midiMeta            = 0xFF
+	midiMetaMarker      = 0x06
+	midiMetaEndOfTrack  = 0x2F
+	midiMetaTempo       = 0x51
+	// controllers
+	midiControlVolume      = 7
+	midiControlPan         = 10
+	midiControlExpression  = 11
+	midiControlLoopStart   = 111
+	midiControlResetAll    = 121
+	midiControlAllNotesOff = 123
+	midiDrumChannel        = 9
+	// pitch bend range, in semitones
+	midiBendRange = 2.0
+	// loop start marker text
+	midiLoopStartMarker = "loopStart"
+)
+
+var (
+	midiIdent        = []byte{'M', 'T', 'h', 'd'}
+	midiTrackIdent   = []byte{'M', 'T', 'r', 'k'}
+	ErrMIDITruncated = errors.New("truncated MIDI file")
+)
+
+// isMIDIFile returns true if r holds a standard MIDI file.
+func isMIDIFile(r io.ReadSeeker) bool {
+	ident := make([]byte, len(midiIdent))
+	_, err := io.ReadFull(r, ident)
+	r.Seek(0, io.SeekStart)
+	return err == nil && bytes.Equal(ident, midiIdent)
+}
+
+// midiEvent is a channel message or meta event, at an absolute time in
+// ticks.
+type midiEvent struct {
+	tick   uint32
+	status uint8
+	// meta event type
+	meta uint8
+	data []byte
+}
+
+// order sorts simultaneous events so that notes are released before new
+// ones are allocated.
+func (e *midiEvent) order() int {
+	switch e.status & 0xF0 {
+	case midiNoteOff:
+		return 0
+	case midiNoteOn:
+		if e.data[1] == 0 {
+			return 0
+		}
+		return 2
+	}
+	return 1
+}
+
+func readVLQ(data []byte, pos *int) (uint32, error) {
+	value := uint32(0)
+	for i := 0; i < 4; i++ {
+		if *pos >= len(data) {
+			return 0, ErrMIDITruncated
+		}
+		b := data[*pos]
+		*pos++
+		value = (value << 7) | uint32(b&0x7F)
+		if (b & 0x80) == 0 {
+			return value, nil
+		}
+	}
+	return 0, errors.New("invalid MIDI variable-length quantity")
+}
+
+// readMIDITrack reads the events of one track chunk.
+func readMIDITrack(body []byte) ([]midiEvent, error) {
+	var events []midiEvent
+	tick := uint32(0)
+	running := uint8(0)
+	pos := 0
+	for pos < len(body) {
+		delta, err := readVLQ(body, &pos)
+		if err != nil {
+			return nil, err
+		}
+		tick += delta
+		if pos >= len(body) {
+			return nil, ErrMIDITruncated
+		}
+		status := body[pos]
+		if status < 0x80 {
+			if running == 0 {
+				return nil, errors.New("MIDI data byte without status")
+			}
+			status = running
+		} else {
+			pos++
+		}
+		switch {
+		case status == midiMeta:
+			if pos >= len(body) {
+				return nil, ErrMIDITruncated
+			}
+			meta := body[pos]
+			pos++
+			length, err := readVLQ(body, &pos)
+			if err != nil {
+				return nil, err
+			}
+			if pos+int(length) > len(body) {
+				return nil, ErrMIDITruncated
+			}
+			if meta == midiMetaEndOfTrack {
+				return events, nil
+			}
+			events = append(events, midiEvent{tick, status, meta, body[pos : pos+int(length)]})
+			pos += int(length)
+		case status == midiSysEx || status == midiSysExEscape:
+			length, err := readVLQ(body, &pos)
+			if err != nil {
+				return nil, err
+			}
+			pos += int(length)
+			running = 0
+		case status > midiSysEx:
+			return nil, fmt.Errorf("unsupported MIDI status %02X", status)
+		default:
+			running = status
+			length := 2
+			if (status&0xF0) == midiProgramChange || (status&0xF0) == midiChannelPressure {
+				length = 1
+			}
+			if pos+length > len(body) {
+				return nil, ErrMIDITruncated
+			}
+			events = append(events, midiEvent{tick, status, 0, body[pos : pos+length]})
+			pos += length
+		}
+	}
+	return events, nil
+}
+
+// readMIDIFile reads a standard MIDI file, returning its ticks per quarter
+// note and the events of all tracks in playback order.
+func readMIDIFile(data []byte) (uint16, []midiEvent, error) {
+	if len(data) < 14 || !bytes.Equal(data[0:4], midiIdent) {
+		return 0, nil, ErrUnsupportedSongFile
+	}
+	headerLength := int(binary.BigEndian.Uint32(data[4:8]))
+	trackCount := int(binary.BigEndian.Uint16(data[10:12]))
+	division := binary.BigEndian.Uint16(data[12:14])
+	if (division & 0x8000) != 0 {
+		return 0, nil, errors.New("SMPTE MIDI time division is not supported")
+	}
+	var events []midiEvent
+	pos := 8 + headerLength
+	for i := 0; i < trackCount; i++ {
+		if pos+8 > len(data) {
+			return 0, nil, ErrMIDITruncated
+		}
+		length := int(binary.BigEndian.Uint32(data[pos+4 : pos+8]))
+		if pos+8+length > len(data) {
+			return 0, nil, ErrMIDITruncated
+		}
+		if bytes.Equal(data[pos:pos+4], midiTrackIdent) {
+			trackEvents, err := readMIDITrack(data[pos+8 : pos+8+length])
+			if err != nil {
+				return 0, nil, err
+			}
+			events = append(events, trackEvents...)
+		}
+		pos += 8 + length
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].tick != events[j].tick {
+			return events[i].tick < events[j].tick
+		}
+		return events[i].order() < events[j].order()
+	})
+	return division, events, nil
+}
+
+// midiChannel is the controller state of a MIDI channel.
+type midiChannel struct {
+	program    uint8
+	volume     uint8
+	expression uint8
+	pan        uint8
+	// pitch bend, in semitones
+	bend float64
+}
+
+// midiVoice is a note playing on a WonderSwan channel.
+type midiVoice struct {
+	instrument *Instrument
+	channel    uint8
+	note       uint8
+	velocity   uint8
+	pitch      uint8
+	// envelope ticks since the note started or was released
+	ticks    int
+	released bool
+	// allocation order, for stealing the oldest voice
+	order int
+}
+
+func (v *midiVoice) level() uint8 {
+	if v.released {
+		if v.ticks < len(v.instrument.Release) {
+			return v.instrument.Release[v.ticks]
+		}
+		return 0
+	}
+	if v.ticks < len(v.instrument.Envelope) {
+		return v.instrument.Envelope[v.ticks]
+	}
+	return v.instrument.Envelope[len(v.instrument.Envelope)-1]
+}
+
+func (v *midiVoice) finished() bool {
+	return v.released && v.ticks >= len(v.instrument.Release)
+}
+
+// changing returns true if the voice's envelope has not reached its end.
+func (v *midiVoice) changing() bool {
+	return v.released || v.ticks < len(v.instrument.Envelope)-1
+}
+
+func (v *midiVoice) release() {
+	v.released = true
+	v.ticks = 0
+}
+
+// midiConverter plays MIDI events on the WonderSwan channels, allocating a
+// channel to every note.
+type midiConverter struct {
+	translationReport
+	instruments *InstrumentSet
+	channels    [16]midiChannel
+	voices      [4]*midiVoice
+	allocations int
+}
+
+func newMIDIConverter(instruments *InstrumentSet) *midiConverter {
+	c := midiConverter{instruments: instruments}
+	for i := range c.channels {
+		c.channels[i] = midiChannel{volume: 100, expression: 127, pan: 64}
+	}
+	return &c
+}
+
+func (c *midiConverter) noteOn(channel uint8, note uint8, velocity uint8) {
+	drum := channel == midiDrumChannel
+	key := c.channels[channel].program
+	if drum {
+		key = note
+	}
+	inst := c.instruments.find(key, drum)
+	if inst == nil {
+		if drum {
+			c.drop(fmt.Sprintf("notes for undefined drum key %d", key))
+		} else {
+			c.drop(fmt.Sprintf("notes for undefined program %d", key))
+		}
+		return
+	}
+	pitch := note
+	if drum && inst.Pitch != nil {
+		pitch = *inst.Pitch
+	}
+
+	// prefer free channels, then released notes, then the oldest note
+	best, bestScore := -1, 0
+	for i, v := range c.voices {
+		if (inst.channelMask & (1 << i)) == 0 {
+			continue
+		}
+		score := 0
+		if v != nil {
+			score = 1 << 30
+			if !v.released {
+				score <<= 1
+			}
+			score += v.order
+		}
+		if best < 0 || score < bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if c.voices[best] != nil && !c.voices[best].released {
+		c.drop("notes cut short by channel allocation")
+	}
+	c.voices[best] = &midiVoice{
+		instrument: inst,
+		channel:    channel,
+		note:       note,
+		velocity:   velocity,
+		pitch:      pitch,
+		order:      c.allocations,
+	}
+	c.allocations++
+}
+
+func (c *midiConverter) noteOff(channel uint8, note uint8, all bool) {
+	for i, v := range c.voices {
+		if v != nil && !v.released && v.channel == channel && (all || v.note == note) {
+			v.release()
+			if v.finished() {
+				c.voices[i] = nil
+			}
+		}
+	}
+}
+
+func (c *midiConverter) handle(e *midiEvent) {
+	channel := e.status & 0x0F
+	ch := &c.channels[channel]
+	switch e.status & 0xF0 {
+	case midiNoteOff:
+		c.noteOff(channel, e.data[0], false)
+	case midiNoteOn:
+		if e.data[1] == 0 {
+			c.noteOff(channel, e.data[0], false)
+		} else {
+			c.noteOn(channel, e.data[0], e.data[1])
+		}
+	case midiProgramChange:
+		ch.program = e.data[0]
+	case midiPitchBend:
+		value := int(e.data[0]) | int(e.data[1])<<7
+		ch.bend = float64(value-8192) / 8192 * midiBendRange
+	case midiControlChange:
+		switch e.data[0] {
+		case midiControlVolume:
+			ch.volume = e.data[1]
+		case midiControlPan:
+			ch.pan = e.data[1]
+		case midiControlExpression:
+			ch.expression = e.data[1]
+		case midiControlResetAll:
+			ch.expression = 127
+			ch.bend = 0
+		case midiControlAllNotesOff:
+			c.noteOff(channel, 0, true)
+		}
+	}
+}
+
+// changing returns true if any voice's envelope has not reached its end.
+func (c *midiConverter) changing() bool {
+	for _, v := range c.voices {
+		if v != nil && v.changing() {
+			return true
+		}
+	}
+	return false
+}
+
+// tick advances all envelopes by one tick.
+func (c *midiConverter) tick() {
+	for i, v := range c.voices {
+		if v != nil {
+			v.ticks++
+			if v.finished() {
+				c.voices[i] = nil
+			}
+		}
+	}
+}
+
+func (c *midiConverter) update(ws *wsShadow) {
+	chCtrl := uint8(0x0F)
+	ws.ports[portNoiseCtrl] = 0x00
+	for i, v := range c.voices {
+		if v == nil {
+			ws.setVolume(i, 0, 0)
+			continue
+		}
+		ch := &c.channels[v.channel]
+		frequency := 440 * math.Pow(2, (float64(v.pitch)-69+ch.bend)/12)
+		if v.instrument.Noise != nil {
+			ws.setRate(i, frequency*wsWaveLength)
+			ws.ports[portNoiseCtrl] = 0x10 | *v.instrument.Noise
+			chCtrl |= chCtrlNoise
+		} else {
+			ws.setWave(i, (*[wsWaveLength]uint8)(v.instrument.Wave))
+			ws.setFrequency(i, frequency)
+		}
+		amplitude := float64(v.level()) / 15 * float64(v.velocity) / 127 *
+			float64(ch.volume) / 127 * float64(ch.expression) / 127
+		left, right := 1.0, 1.0
+		if ch.pan < 64 {
+			right = float64(ch.pan) / 64
+		} else {
+			left = float64(127-ch.pan) / 63
+		}
+		ws.setVolume(i, amplitude*left, amplitude*right)
+	}
+	ws.ports[portChCtrl] = chCtrl
+}
+
+func parseMIDI(r io.Reader, instruments *InstrumentSet, markers []Marker) (*Song, error) {
+	var song Song
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	division, events, err := readMIDIFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newMIDIConverter(instruments)
+	var shadow wsShadow
+	frame := CommandFrame{}
+	unitsPerSecond := waitUnitsPerSecond()
+	now := 0.0
+	waitUntil := func(t float64) {
+		units := math.Round(t*unitsPerSecond) - math.Round(now*unitsPerSecond)
+		now = t
+		for units > 0 {
+			length := math.Min(units, 0xFFFF)
+			frame.Commands = append(frame.Commands, &CommandWait{uint32(length)})
+			newFrame := frame
+			song.Commands = append(song.Commands, &newFrame)
+			frame = CommandFrame{}
+			units -= length
+		}
+	}
+	// envelopes tick on a fixed grid, while they are changing
+	tickPeriod := 1 / instruments.TickRate
+	nextTick := tickPeriod
+	runTicks := func(t float64) {
+		for nextTick <= t {
+			if !c.changing() {
+				nextTick = (math.Floor(t/tickPeriod) + 1) * tickPeriod
+				break
+			}
+			waitUntil(nextTick)
+			c.tick()
+			c.update(&shadow)
+			shadow.emit(&frame)
+			nextTick += tickPeriod
+		}
+	}
+
+	tempo := 500000.0
+	seconds := 0.0
+	lastTick := uint32(0)
+	markerIdx := 0
+	for i := range events {
+		e := &events[i]
+		seconds += float64(e.tick-lastTick) * tempo / (float64(division) * 1e6)
+		lastTick = e.tick
+		for markerIdx < len(markers) && float64(markers[markerIdx].Position)/vgm.VGM_SAMPLES_PER_SECOND <= seconds {
+			markerTime := float64(markers[markerIdx].Position) / vgm.VGM_SAMPLES_PER_SECOND
+			runTicks(markerTime)
+			waitUntil(markerTime)
+			frame.Commands = append(frame.Commands, &CommandMarker{markers[markerIdx].ID})
+			markerIdx++
+		}
+		runTicks(seconds)
+		waitUntil(seconds)
+
+		loopStart := false
+		switch {
+		case e.status == midiMeta && e.meta == midiMetaTempo && len(e.data) == 3:
+			tempo = float64(uint32(e.data[0])<<16 | uint32(e.data[1])<<8 | uint32(e.data[2]))
+		case e.status == midiMeta && e.meta == midiMetaMarker:
+			loopStart = strings.EqualFold(string(e.data), midiLoopStartMarker)
+		case e.status == midiMeta:
+		case (e.status&0xF0) == midiControlChange && e.data[0] == midiControlLoopStart:
+			loopStart = true
+		default:
+			c.handle(e)
+		}
+		if loopStart {
+			// commands of earlier events at the same time are not replayed
+			if len(frame.Commands) > 0 {
+				newFrame := frame
+				song.Commands = append(song.Commands, &newFrame)
+				frame = CommandFrame{}
+			}
+			frame.LoopFrame = true
+			song.LoopCount = LoopForever
+			shadow.invalidate()
+		}
+		c.update(&shadow)
+		shadow.emit(&frame)
+	}
+	// let released notes fade, then stop
+	for c.changing() {
+		runTicks(nextTick)
+	}
+	c.voices = [4]*midiVoice{}
+	c.update(&shadow)
+	shadow.emit(&frame)
+	frame.Commands = append(frame.Commands, &CommandWait{1})
+	song.Commands = append(song.Commands, &frame)
+
+	mergeWaits(&song)
+	c.dropped().print()
+	song.DroppedMarkers = len(markers) - markerIdx
+	return &song, nil
+}
@@ -0,0 +1,362 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// midiEv returns a MIDI track event following a delta time in ticks.
+func midiEv(delta uint32, data ...byte) []byte {
+	vlq := []byte{byte(delta & 0x7F)}
+	for delta >>= 7; delta > 0; delta >>= 7 {
+		vlq = append([]byte{byte(0x80 | delta&0x7F)}, vlq...)
+	}
+	return append(vlq, data...)
+}
+
+// midiFile builds a standard MIDI file from tracks of events, adding the
+// end of track events.
+func midiFile(division uint16, tracks ...[]byte) []byte {
+	data := []byte{'M', 'T', 'h', 'd', 0, 0, 0, 6, 0, 1, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(data[10:], uint16(len(tracks)))
+	binary.BigEndian.PutUint16(data[12:], division)
+	for _, track := range tracks {
+		track = append(track, midiEv(0, midiMeta, midiMetaEndOfTrack, 0)...)
+		data = append(data, 'M', 'T', 'r', 'k', 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(data[len(data)-4:], uint32(len(track)))
+		data = append(data, track...)
+	}
+	return data
+}
+
+// songPortWrites lists a song's writes to a port, with the loop frame
+// marked by "loop".
+func songPortWrites(song *Song, port uint8) []string {
+	result := []string{}
+	for _, frame := range song.Commands {
+		if frame.LoopFrame {
+			result = append(result, "loop")
+		}
+		for _, cmdRaw := range frame.Commands {
+			if cmd, ok := cmdRaw.(*CommandWritePort); ok && cmd.Address == port {
+				result = append(result, fmt.Sprintf("% X", cmd.Data))
+			}
+		}
+	}
+	return result
+}
+
+func TestReadVLQ(t *testing.T) {
+	tests := []struct {
+		data    []byte
+		want    uint32
+		wantErr bool
+	}{
+		{[]byte{0x00}, 0, false},
+		{[]byte{0x7F}, 0x7F, false},
+		{[]byte{0x81, 0x00}, 0x80, false},
+		{[]byte{0xFF, 0xFF, 0xFF, 0x7F}, 0x0FFFFFFF, false},
+		{[]byte{0x81}, 0, true},
+		{[]byte{0x80, 0x80, 0x80, 0x80, 0x00}, 0, true},
+	}
+	for _, tt := range tests {
+		pos := 0
+		got, err := readVLQ(tt.data, &pos)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("% X: error %v, want error %v", tt.data, err, tt.wantErr)
+		} else if got != tt.want {
+			t.Errorf("% X: got %X, want %X", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestReadMIDIFile(t *testing.T) {
+	data := midiFile(480,
+		concat(
+			midiEv(0, midiNoteOn, 60, 100),
+			// running status
+			midiEv(10, 62, 100),
+			midiEv(0, midiSysEx, 1, 0xF7),
+			midiEv(10, midiNoteOn|1, 64, 0),
+		),
+		concat(
+			midiEv(20, midiProgramChange, 5),
+			midiEv(0, midiNoteOff, 60, 0),
+		),
+	)
+	division, events, err := readMIDIFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if division != 480 {
+		t.Errorf("division: got %d, want 480", division)
+	}
+	// simultaneous events release notes first
+	want := []string{"0:90 3C 64", "10:90 3E 64", "20:91 40 00", "20:80 3C 00", "20:C0 05"}
+	got := make([]string, len(events))
+	for i, e := range events {
+		got[i] = fmt.Sprintf("%d:%02X % X", e.tick, e.status, e.data)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("events: got %q, want %q", got, want)
+	}
+}
+
+func TestReadMIDIFileErrors(t *testing.T) {
+	smpte := midiFile(480)
+	smpte[12] = 0xE7
+	truncated := midiFile(480, midiEv(0, midiNoteOn, 60, 100))
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{"not a MIDI file", []byte("RIFF0000WAVEfmt "), ErrUnsupportedSongFile},
+		{"SMPTE time division", smpte, nil},
+		{"truncated file", truncated[:len(truncated)-4], ErrMIDITruncated},
+		{"truncated event", midiFile(480, midiEv(0, midiNoteOn, 60)), ErrMIDITruncated},
+		{"data without status", midiFile(480, midiEv(0, 60, 100)), nil},
+		{"unsupported status", midiFile(480, midiEv(0, 0xF1, 0)), nil},
+	}
+	for _, tt := range tests {
+		_, _, err := readMIDIFile(tt.data)
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		} else if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMIDIConverter(t *testing.T) {
+	instruments, err := readTestInstruments(t, `{
+		"instruments": [
+			{"program": 0, "channels": "12"},
+			{"drum": 36, "pitch": 69, "noise": 2}
+		]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		events      []midiEvent
+		want        map[uint8]uint8
+		wantDropped map[string]int
+	}{
+		{
+			// A4 at velocity 127 and the default channel volume of 100
+			"note",
+			[]midiEvent{{0, midiNoteOn, 0, []byte{69, 127}}},
+			map[uint8]uint8{portFreqCh1: 0x26, portFreqCh1 + 1: 0x07, portVolCh1: 0xCC, portChCtrl: 0x0F},
+			nil,
+		},
+		{
+			"note off",
+			[]midiEvent{{0, midiNoteOn, 0, []byte{69, 127}}, {0, midiNoteOn, 0, []byte{69, 0}}},
+			map[uint8]uint8{portVolCh1: 0x00},
+			nil,
+		},
+		{
+			"volume, expression and pan",
+			[]midiEvent{
+				{0, midiControlChange, 0, []byte{midiControlVolume, 127}},
+				{0, midiControlChange, 0, []byte{midiControlExpression, 127}},
+				{0, midiControlChange, 0, []byte{midiControlPan, 0}},
+				{0, midiNoteOn, 0, []byte{69, 127}},
+			},
+			map[uint8]uint8{portVolCh1: 0xF0},
+			nil,
+		},
+		{
+			// two semitones up, to A4
+			"pitch bend",
+			[]midiEvent{{0, midiNoteOn, 0, []byte{67, 127}}, {0, midiPitchBend, 0, []byte{0x7F, 0x7F}}},
+			map[uint8]uint8{portFreqCh1: 0x26, portFreqCh1 + 1: 0x07},
+			nil,
+		},
+		{
+			"all notes off",
+			[]midiEvent{
+				{0, midiNoteOn, 0, []byte{69, 127}},
+				{0, midiNoteOn, 0, []byte{72, 127}},
+				{0, midiControlChange, 0, []byte{midiControlAllNotesOff, 0}},
+			},
+			map[uint8]uint8{portVolCh1: 0x00, portVolCh1 + 1: 0x00},
+			nil,
+		},
+		{
+			"channel allocation",
+			[]midiEvent{
+				{0, midiNoteOn, 0, []byte{60, 127}},
+				{0, midiNoteOn, 0, []byte{64, 127}},
+				{0, midiNoteOn, 0, []byte{69, 127}},
+			},
+			map[uint8]uint8{portFreqCh1: 0x26, portFreqCh1 + 1: 0x07, portVolCh1 + 2: 0x00},
+			map[string]int{"notes cut short by channel allocation": 1},
+		},
+		{
+			"drum",
+			[]midiEvent{{0, midiNoteOn | midiDrumChannel, 0, []byte{36, 127}}},
+			map[uint8]uint8{portFreqCh1 + 6: 0x26, portFreqCh1 + 7: 0x07, portNoiseCtrl: 0x12, portChCtrl: 0x8F},
+			nil,
+		},
+		{
+			"undefined instruments",
+			[]midiEvent{
+				{0, midiProgramChange, 0, []byte{5}},
+				{0, midiNoteOn, 0, []byte{69, 127}},
+				{0, midiNoteOn | midiDrumChannel, 0, []byte{38, 127}},
+			},
+			map[uint8]uint8{portVolCh1: 0x00, portVolCh1 + 3: 0x00},
+			map[string]int{"notes for undefined program 5": 1, "notes for undefined drum key 38": 1},
+		},
+	}
+	for _, tt := range tests {
+		c := newMIDIConverter(instruments)
+		for i := range tt.events {
+			c.handle(&tt.events[i])
+		}
+		var ws wsShadow
+		c.update(&ws)
+		checkPorts(t, tt.name, &ws, tt.want)
+		checkDropped(t, tt.name, c, tt.wantDropped)
+	}
+}
+
+func TestParseMIDI(t *testing.T) {
+	defer func(v bool, w int) { HBlankTiming, WaveBase = v, w }(HBlankTiming, WaveBase)
+	HBlankTiming, WaveBase = true, -1
+
+	instruments, err := readTestInstruments(t, `{
+		"instruments": [
+			{"envelope": [15, 8, 4]}
+		]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	note := concat(midiEv(0, midiNoteOn, 69, 127), midiEv(480, midiNoteOff, 69, 0))
+	tests := []struct {
+		name       string
+		track      []byte
+		markers    []Marker
+		wantVolume []string
+		wantWaits  uint32
+		wantLoop   int
+	}{
+		{
+			// a quarter note lasts half a second; envelopes tick at 75 Hz
+			"envelope",
+			note,
+			nil,
+			[]string{"CC 00", "66", "33", "00"},
+			6001,
+			0,
+		},
+		{
+			"loop controller",
+			concat(note, midiEv(0, midiControlChange, midiControlLoopStart, 0), note),
+			nil,
+			[]string{"CC 00", "66", "33", "00", "loop", "00 00", "CC", "66", "33", "00"},
+			12001,
+			LoopForever,
+		},
+		{
+			// the state written by the tempo event is written again at the
+			// loop start
+			"loop marker",
+			concat(
+				midiEv(0, midiMeta, midiMetaTempo, 3, 0x07, 0xA1, 0x20),
+				midiEv(0, midiMeta, midiMetaMarker, 9, 'l', 'o', 'o', 'p', 'S', 't', 'a', 'r', 't'),
+				note,
+			),
+			nil,
+			[]string{"00 00", "loop", "00 00", "CC", "66", "33", "00"},
+			6001,
+			LoopForever,
+		},
+		{
+			"tempo",
+			concat(midiEv(0, midiMeta, midiMetaTempo, 3, 0x0F, 0x42, 0x40), note),
+			nil,
+			[]string{"00 00", "CC", "66", "33", "00"},
+			12001,
+			0,
+		},
+	}
+	for _, tt := range tests {
+		song, err := parseMIDI(bytes.NewReader(midiFile(480, tt.track)), instruments, tt.markers)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if got := songPortWrites(song, portVolCh1); fmt.Sprint(got) != fmt.Sprint(tt.wantVolume) {
+			t.Errorf("%s: volume writes %q, want %q", tt.name, got, tt.wantVolume)
+		}
+		if got := songWaits(song); got != tt.wantWaits {
+			t.Errorf("%s: waits add up to %d, want %d", tt.name, got, tt.wantWaits)
+		}
+		if song.LoopCount != tt.wantLoop {
+			t.Errorf("%s: loop count %d, want %d", tt.name, song.LoopCount, tt.wantLoop)
+		}
+	}
+}
+
+func TestParseMIDIMarkers(t *testing.T) {
+	defer func(v bool) { HBlankTiming = v }(HBlankTiming)
+	HBlankTiming = true
+
+	instruments, err := readTestInstruments(t, `{"instruments": [{}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	track := concat(midiEv(0, midiNoteOn, 69, 127), midiEv(480, midiNoteOff, 69, 0))
+	markers := []Marker{{11025, 1}, {22050, 2}, {44100, 3}}
+	song, err := parseMIDI(bytes.NewReader(midiFile(480, track)), instruments, markers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// waits before each marker
+	var got []uint32
+	wait := uint32(0)
+	for _, frame := range song.Commands {
+		for _, cmdRaw := range frame.Commands {
+			switch cmd := cmdRaw.(type) {
+			case *CommandWait:
+				wait += cmd.Length
+			case *CommandMarker:
+				got = append(got, wait)
+			}
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint([]uint32{3000, 6000}) {
+		t.Errorf("markers placed after %v wait units, want [3000 6000]", got)
+	}
+	if song.DroppedMarkers != 1 {
+		t.Errorf("dropped markers: got %d, want 1", song.DroppedMarkers)
+	}
+}
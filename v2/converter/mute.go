@@ -0,0 +1,105 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+// filterCommand removes all writes to the given channels from a command,
+// returning the remaining commands.
+func filterCommand(cmdRaw interface{}, channels uint8) []interface{} {
+	switch cmd := cmdRaw.(type) {
+	case *CommandWritePort:
+		result := []interface{}{}
+		var current *CommandWritePort
+		for i, v := range cmd.Data {
+			addr := cmd.Address + uint8(i)
+			if addr == portChCtrl {
+				v &^= chCtrlBits(channels)
+			} else if (portChannels(addr) & channels) != 0 {
+				current = nil
+				continue
+			}
+			if current == nil {
+				current = &CommandWritePort{addr, []byte{}}
+				result = append(result, current)
+			}
+			current.Data = append(current.Data, v)
+		}
+		return result
+	case *CommandWriteMemory:
+		result := []interface{}{}
+		var current *CommandWriteMemory
+		for i, v := range cmd.Data {
+			addr := cmd.Address + uint16(i)
+			if (commandChannels(&CommandWriteMemory{addr, []byte{v}}) & channels) != 0 {
+				current = nil
+				continue
+			}
+			if current == nil {
+				current = &CommandWriteMemory{addr, []byte{}}
+				result = append(result, current)
+			}
+			current.Data = append(current.Data, v)
+		}
+		return result
+	case *CommandPlaySample:
+		if (channels & 0x02) != 0 {
+			return []interface{}{}
+		}
+	}
+	return []interface{}{cmdRaw}
+}
+
+// mergeWaits merges frames consisting of only a wait into the wait ending
+// the frame before them.
+func mergeWaits(song *Song) {
+	newFrames := make([]*CommandFrame, 0, len(song.Commands))
+	for _, frame := range song.Commands {
+		if len(newFrames) > 0 && len(frame.Commands) == 1 && !frame.LoopFrame {
+			prevFrame := newFrames[len(newFrames)-1]
+			wait, ok := frame.Commands[0].(*CommandWait)
+			prevWait, prevOk := prevFrame.Commands[len(prevFrame.Commands)-1].(*CommandWait)
+			if ok && prevOk && prevWait.Length+wait.Length <= 0xFFFF {
+				prevFrame.Commands[len(prevFrame.Commands)-1] = &CommandWait{prevWait.Length + wait.Length}
+				continue
+			}
+		}
+		newFrames = append(newFrames, frame)
+	}
+	song.Commands = newFrames
+}
+
+// MuteChannels drops every write to the given channels from a song, merging
+// the waits of frames which become empty as a result.
+func MuteChannels(song *Song, channels uint8) {
+	if channels == 0 {
+		return
+	}
+	if (channels & 0x02) != 0 {
+		song.Samples = nil
+	}
+	for _, frame := range song.Commands {
+		newCommands := make([]interface{}, 0, len(frame.Commands))
+		for _, cmd := range frame.Commands {
+			newCommands = append(newCommands, filterCommand(cmd, channels)...)
+		}
+		frame.Commands = newCommands
+	}
+	mergeWaits(song)
+}
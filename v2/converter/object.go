@@ -0,0 +1,191 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// Bank data must start at the beginning of a 64 KiB ROM bank. Bank deltas
+// and the next bank command (F7) expect the following banks to follow it
+// directly, so all of them are written to a single section.
+const bankAlignment = 0x10000
+
+// splitBanks splits bank data into 64 KiB ROM banks.
+func splitBanks(data []byte) [][]byte {
+	var banks [][]byte
+	for len(data) > 0 {
+		size := len(data)
+		if size > 0x10000 {
+			size = 0x10000
+		}
+		banks = append(banks, data[:size])
+		data = data[size:]
+	}
+	return banks
+}
+
+func objectSymbolName(bank int) string {
+	return fmt.Sprintf("%s%d", ObjectSymbolName, bank)
+}
+
+// WriteCSource writes bank data as a C source file, with one symbol per ROM
+// bank. The data itself is emitted as a single top-level assembly block, as
+// the compiler is free to reorder separate arrays.
+func WriteCSource(filename string, data []byte) error {
+	banks := splitBanks(data)
+	var b bytes.Buffer
+	b.WriteString("// Generated by the vgmswan converter; do not edit.\n")
+	b.WriteString("#include <stdint.h>\n\n")
+	for i, bank := range banks {
+		fmt.Fprintf(&b, "extern const uint8_t __far %s[%d];\n", objectSymbolName(i), len(bank))
+	}
+	fmt.Fprintf(&b, "\n__asm__(\n\t\".section %s, \\\"a\\\"\\n\"\n", ObjectSectionName)
+	fmt.Fprintf(&b, "\t\".balign %d\\n\"\n", bankAlignment)
+	for i, bank := range banks {
+		fmt.Fprintf(&b, "\t\".global %s\\n\"\n", objectSymbolName(i))
+		fmt.Fprintf(&b, "\t\"%s:\\n\"", objectSymbolName(i))
+		for j, v := range bank {
+			if (j & 15) == 0 {
+				if j > 0 {
+					b.WriteString("\\n\"")
+				}
+				b.WriteString("\n\t\".byte ")
+			} else {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, "0x%02X", v)
+		}
+		b.WriteString("\\n\"\n")
+	}
+	b.WriteString("\t\".previous\\n\"\n);\n")
+	return os.WriteFile(filename, b.Bytes(), 0644)
+}
+
+type elfStringTable struct {
+	data bytes.Buffer
+}
+
+func (t *elfStringTable) add(s string) uint32 {
+	if t.data.Len() == 0 {
+		t.data.WriteByte(0)
+	}
+	pos := uint32(t.data.Len())
+	t.data.WriteString(s)
+	t.data.WriteByte(0)
+	return pos
+}
+
+// WriteELFObject writes bank data as an ELF relocatable object, with a
+// single section holding all ROM banks and one global symbol per bank.
+func WriteELFObject(filename string, data []byte) error {
+	var shstrtab, strtab elfStringTable
+	shstrtab.add("")
+	strtab.add("")
+
+	// section layout: null, bank data, .symtab, .strtab, .shstrtab
+	const dataIdx = 1
+	symtabIdx := dataIdx + 1
+	strtabIdx := symtabIdx + 1
+	shstrtabIdx := strtabIdx + 1
+	sections := make([]elf.Section32, shstrtabIdx+1)
+	symbols := []elf.Sym32{{}}
+
+	var body bytes.Buffer
+	offset := uint32(binary.Size(elf.Header32{}))
+	sections[dataIdx] = elf.Section32{
+		Name:      shstrtab.add(ObjectSectionName),
+		Type:      uint32(elf.SHT_PROGBITS),
+		Flags:     uint32(elf.SHF_ALLOC),
+		Off:       offset,
+		Size:      uint32(len(data)),
+		Addralign: bankAlignment,
+	}
+	body.Write(data)
+	for i, bank := range splitBanks(data) {
+		symbols = append(symbols, elf.Sym32{
+			Name:  strtab.add(objectSymbolName(i)),
+			Value: uint32(i * 0x10000),
+			Size:  uint32(len(bank)),
+			Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT),
+			Shndx: dataIdx,
+		})
+	}
+
+	for body.Len()%4 != 0 {
+		body.WriteByte(0)
+	}
+	sections[symtabIdx] = elf.Section32{
+		Name:      shstrtab.add(".symtab"),
+		Type:      uint32(elf.SHT_SYMTAB),
+		Off:       offset + uint32(body.Len()),
+		Size:      uint32(len(symbols) * elf.Sym32Size),
+		Link:      uint32(strtabIdx),
+		Info:      1, // first non-local symbol
+		Addralign: 4,
+		Entsize:   elf.Sym32Size,
+	}
+	binary.Write(&body, binary.LittleEndian, symbols)
+
+	sections[strtabIdx] = elf.Section32{
+		Name:      shstrtab.add(".strtab"),
+		Type:      uint32(elf.SHT_STRTAB),
+		Off:       offset + uint32(body.Len()),
+		Size:      uint32(strtab.data.Len()),
+		Addralign: 1,
+	}
+	body.Write(strtab.data.Bytes())
+
+	sections[shstrtabIdx].Name = shstrtab.add(".shstrtab")
+	sections[shstrtabIdx].Type = uint32(elf.SHT_STRTAB)
+	sections[shstrtabIdx].Off = offset + uint32(body.Len())
+	sections[shstrtabIdx].Size = uint32(shstrtab.data.Len())
+	sections[shstrtabIdx].Addralign = 1
+	body.Write(shstrtab.data.Bytes())
+
+	for body.Len()%4 != 0 {
+		body.WriteByte(0)
+	}
+	header := elf.Header32{
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(elf.EM_386),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     offset + uint32(body.Len()),
+		Ehsize:    uint16(binary.Size(elf.Header32{})),
+		Shentsize: uint16(binary.Size(elf.Section32{})),
+		Shnum:     uint16(len(sections)),
+		Shstrndx:  uint16(shstrtabIdx),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &header)
+	b.Write(body.Bytes())
+	binary.Write(&b, binary.LittleEndian, sections)
+	return os.WriteFile(filename, b.Bytes(), 0644)
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Offsets within the 16-byte ROM footer.
+const (
+	romFooterSize        = 16
+	romFooterPublisherID = 0x6
+	romFooterColor       = 0x7
+	romFooterGameID      = 0x8
+	romFooterRevision    = 0x9
+	romFooterROMSize     = 0xA
+	romFooterSaveType    = 0xB
+	romFooterFlags       = 0xC
+	romFooterMapper      = 0xD
+	romFooterChecksum    = 0xE
+	romFlagVertical      = 0x01
+	romMapper2001        = 0x00
+	romMapper2003        = 0x01
+	// the reset vector at the start of the footer is a far jump
+	romFooterJumpOpcode = 0xEA
+	// engines find their data relative to the last bank, so they must fit
+	// within it
+	maxEngineSize = 0x10000
+)
+
+// EngineFilename is an external engine image to build test ROMs with, in
+// place of the embedded one.
+var EngineFilename string
+
+var romSaveTypes = map[string]uint8{
+	"none":       0x00,
+	"sram-8k":    0x01,
+	"sram-32k":   0x02,
+	"sram-128k":  0x03,
+	"sram-256k":  0x04,
+	"sram-512k":  0x05,
+	"eeprom-128": 0x10,
+	"eeprom-2k":  0x20,
+	"eeprom-1k":  0x50,
+}
+
+// ROMHeaderOptions holds ROM footer fields to override when building a test
+// ROM; nil fields keep the engine's values.
+type ROMHeaderOptions struct {
+	PublisherID *uint8
+	GameID      *uint8
+	Revision    *uint8
+	Color       *bool
+	Vertical    *bool
+	SaveType    *uint8
+	RTC         *bool
+	Mapper      *uint8
+}
+
+var ROMHeader ROMHeaderOptions
+
+func parseSaveType(value string) (uint8, error) {
+	if v, ok := romSaveTypes[value]; ok {
+		return v, nil
+	}
+	v, err := strconv.ParseUint(value, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid save type %q", value)
+	}
+	return uint8(v), nil
+}
+
+func parseMapper(value string) (uint8, error) {
+	switch value {
+	case "2001":
+		return romMapper2001, nil
+	case "2003":
+		return romMapper2003, nil
+	}
+	return 0, fmt.Errorf("invalid mapper %q", value)
+}
+
+func parseOrientation(value string) (bool, error) {
+	switch value {
+	case "horizontal":
+		return false, nil
+	case "vertical":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid orientation %q", value)
+}
+
+func byteFlag(target **uint8) func(string) error {
+	return func(value string) error {
+		v, err := strconv.ParseUint(value, 0, 8)
+		if err != nil {
+			return fmt.Errorf("invalid value %q", value)
+		}
+		b := uint8(v)
+		*target = &b
+		return nil
+	}
+}
+
+func (o *ROMHeaderOptions) registerFlags() {
+	flag.Func("rom-publisher", "Test ROM publisher ID.", byteFlag(&o.PublisherID))
+	flag.Func("rom-game-id", "Test ROM game ID.", byteFlag(&o.GameID))
+	flag.Func("rom-revision", "Test ROM revision.", byteFlag(&o.Revision))
+	flag.Func("rom-color", "Test ROM color flag: true or false.", func(value string) error {
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		o.Color = &v
+		return nil
+	})
+	flag.Func("rom-orientation", "Test ROM orientation: horizontal or vertical.", func(value string) error {
+		v, err := parseOrientation(value)
+		o.Vertical = &v
+		return err
+	})
+	flag.Func("rom-save-type", "Test ROM save type: none, sram-8k, sram-32k, sram-128k, sram-256k, sram-512k, eeprom-128, eeprom-1k, eeprom-2k or a number.", func(value string) error {
+		v, err := parseSaveType(value)
+		o.SaveType = &v
+		return err
+	})
+	flag.Func("rom-rtc", "Test ROM RTC presence: true or false; requires the 2003 mapper.", func(value string) error {
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		o.RTC = &v
+		return nil
+	})
+	flag.Func("rom-mapper", "Test ROM mapper: 2001 or 2003.", func(value string) error {
+		v, err := parseMapper(value)
+		o.Mapper = &v
+		return err
+	})
+}
+
+// LoadEngine reads an engine image and checks that it can be placed at the
+// end of a test ROM.
+func LoadEngine(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < romFooterSize {
+		return nil, fmt.Errorf("%s: engine image is smaller than the ROM footer", filename)
+	}
+	if len(data) > maxEngineSize {
+		return nil, fmt.Errorf("%s: engine image is %d bytes, larger than the last bank", filename, len(data))
+	}
+	if data[len(data)-romFooterSize] != romFooterJumpOpcode {
+		return nil, fmt.Errorf("%s: engine image does not end with a ROM footer", filename)
+	}
+	return data, nil
+}
+
+// Apply patches the ROM footer at the end of rom. The checksum is not
+// updated.
+func (o *ROMHeaderOptions) Apply(rom []byte) error {
+	footer := rom[len(rom)-romFooterSize:]
+	setIfPresent(&footer[romFooterPublisherID], o.PublisherID)
+	setIfPresent(&footer[romFooterGameID], o.GameID)
+	setIfPresent(&footer[romFooterRevision], o.Revision)
+	setIfPresent(&footer[romFooterSaveType], o.SaveType)
+	setIfPresent(&footer[romFooterMapper], o.Mapper)
+	if o.Color != nil {
+		footer[romFooterColor] = 0
+		if *o.Color {
+			footer[romFooterColor] = 1
+		}
+	}
+	if o.Vertical != nil {
+		footer[romFooterFlags] &^= romFlagVertical
+		if *o.Vertical {
+			footer[romFooterFlags] |= romFlagVertical
+		}
+	}
+	if o.RTC != nil && *o.RTC {
+		// the RTC is only present on the 2003 mapper
+		if o.Mapper != nil && *o.Mapper != romMapper2003 {
+			return fmt.Errorf("RTC requires the 2003 mapper")
+		}
+		footer[romFooterMapper] = romMapper2003
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/oov/audio/wave"
+)
+
+// sampleTableEntrySize returns the size of a single sample table entry:
+// control byte, position, length and, in HyperVoice mode, the HyperVoice
+// control port values.
+func sampleTableEntrySize() int {
+	if HyperVoice {
+		return 7
+	}
+	return 5
+}
+
+// SampleFile describes a standalone WAV file imported as a sound effect.
+type SampleFile struct {
+	Name      string
+	Filename  string
+	TrimStart int
+	TrimEnd   int
+	Gain      float64
+	Frequency uint32
+}
+
+type NamedSample struct {
+	Name   string
+	Sample *Sample
+}
+
+type SampleFileList []*SampleFile
+
+func (l *SampleFileList) String() string {
+	names := make([]string, len(*l))
+	for i, f := range *l {
+		names[i] = f.Filename
+	}
+	return strings.Join(names, " ")
+}
+
+// Set parses a sample definition of the form
+// file.wav[,name=NAME][,trim=START:END][,gain=GAIN][,rate=HZ].
+func (l *SampleFileList) Set(value string) error {
+	fields := strings.Split(value, ",")
+	f := SampleFile{
+		Filename: fields[0],
+		Gain:     1.0,
+	}
+	f.Name = defaultName(f.Filename)
+	for _, field := range fields[1:] {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("invalid sample option %q", field)
+		}
+		switch key {
+		case "name":
+			f.Name = val
+		case "trim":
+			start, end, _ := strings.Cut(val, ":")
+			if len(start) > 0 {
+				v, err := strconv.Atoi(start)
+				if err != nil || v < 0 {
+					return fmt.Errorf("invalid trim start %q", start)
+				}
+				f.TrimStart = v
+			}
+			if len(end) > 0 {
+				v, err := strconv.Atoi(end)
+				if err != nil || v < 0 {
+					return fmt.Errorf("invalid trim end %q", end)
+				}
+				f.TrimEnd = v
+			}
+		case "gain":
+			v, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return fmt.Errorf("invalid gain %q", val)
+			}
+			f.Gain = v
+		case "rate":
+			v, err := strconv.ParseUint(val, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid rate %q", val)
+			}
+			f.Frequency = uint32(v)
+		default:
+			return fmt.Errorf("unknown sample option %q", key)
+		}
+	}
+	*l = append(*l, &f)
+	return nil
+}
+
+// readWAV reads a WAV file as floating point PCM data, one slice per channel.
+func readWAV(r io.Reader) ([][]float32, uint32, error) {
+	reader, format, err := wave.NewReader(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	channels := int(format.Format.Channels)
+	if channels <= 0 {
+		return nil, 0, fmt.Errorf("invalid channel count %d", channels)
+	}
+
+	buffer := make([][]float32, channels)
+	for i := range buffer {
+		buffer[i] = make([]float32, 4096)
+	}
+	result := make([][]float32, channels)
+	for {
+		n, err := reader.ReadFloat32Interleaved(buffer)
+		for ch := 0; ch < channels; ch++ {
+			result[ch] = append(result[ch], buffer[ch][:n]...)
+		}
+		if err == io.EOF || (err == nil && n == 0) {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+	}
+	return result, format.Format.SamplesPerSec, nil
+}
+
+// mixDown mixes channels of floating point PCM data down to mono.
+func mixDown(channels [][]float32) []float32 {
+	if len(channels) == 1 {
+		return channels[0]
+	}
+	result := make([]float32, len(channels[0]))
+	for i := range result {
+		for _, data := range channels {
+			result[i] += data[i]
+		}
+		result[i] /= float32(len(channels))
+	}
+	return result
+}
+
+// ConvertSampleFile loads a WAV file and converts it to a playable sample,
+// using the same resampling path as VGM PCM data.
+func ConvertSampleFile(f *SampleFile) (*Sample, error) {
+	file, err := os.Open(f.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	channels, freq, err := readWAV(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Filename, err)
+	}
+	if hyperVoiceChannels() == 2 {
+		if len(channels) != 2 {
+			return nil, fmt.Errorf("%s: HyperVoice stereo mode requires a stereo WAV file", f.Filename)
+		}
+	} else {
+		channels = [][]float32{mixDown(channels)}
+	}
+
+	trimEnd := len(channels[0])
+	if f.TrimEnd > 0 && f.TrimEnd < trimEnd {
+		trimEnd = f.TrimEnd
+	}
+	if f.TrimStart >= trimEnd {
+		return nil, fmt.Errorf("%s: trim removes all sample data", f.Filename)
+	}
+	for ch, data := range channels {
+		data = data[f.TrimStart:trimEnd]
+		for i := range data {
+			data[i] *= float32(f.Gain)
+		}
+		channels[ch] = data
+	}
+
+	sample := Sample{}
+	sample.Frequency = f.Frequency
+	if sample.Frequency == 0 {
+		sample.Frequency = resampleTargetFrequency(freq)
+	}
+	switch sample.Frequency {
+	case 4000, 6000, 12000:
+	case 24000:
+		if !Enable24KHzSamples {
+			return nil, fmt.Errorf("%s: 24000 Hz samples require -enable-24khz-samples", f.Filename)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported sample rate %d", f.Filename, sample.Frequency)
+	}
+	resampled := make([][]byte, len(channels))
+	for ch, data := range channels {
+		resampled[ch] = resampleFloat32(data, freq, sample.Frequency/uint32(len(channels)))
+	}
+	outputData := applyHyperVoiceFormat(resampled...)
+	if len(outputData) > 0xFFFF {
+		return nil, fmt.Errorf("%s: sample too long (%d bytes)", f.Filename, len(outputData))
+	}
+
+	fmt.Printf("converted sample %s: %d Hz(%d frames) to %d hz(%d bytes)\n", f.Name, freq, len(channels[0]), sample.Frequency, len(outputData))
+
+	sample.Data = &outputData
+	return &sample, nil
+}
+
+// sampleControlByte returns the Sound DMA control value used to play a sample.
+func sampleControlByte(sample *Sample, repeat bool, reverse bool) uint8 {
+	ctrl := uint8(0x80)
+	if HyperVoice {
+		ctrl |= sdmaTargetHyperVoice
+	}
+	if reverse {
+		ctrl |= 0x40
+	}
+	if repeat {
+		ctrl |= 0x08
+	}
+	switch sample.Frequency {
+	case 4000:
+		break
+	case 6000:
+		ctrl |= 0x01
+	case 12000:
+		ctrl |= 0x02
+	case 24000:
+		ctrl |= 0x03
+	default:
+		panic(fmt.Errorf("unknown frequency %d", sample.Frequency))
+	}
+	return ctrl
+}
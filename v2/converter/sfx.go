@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Size of the priority and channel mask byte following a sound effect table
+// entry's position.
+const sfxTableInfoSize = 1
+
+// SoundEffectFile describes a VGM file converted as a sound effect.
+type SoundEffectFile struct {
+	Name     string
+	Filename string
+	Priority uint8
+	Channels uint8
+}
+
+type SoundEffect struct {
+	Name     string
+	Song     *Song
+	Priority uint8
+	Channels uint8
+}
+
+type SoundEffectFileList []*SoundEffectFile
+
+func (l *SoundEffectFileList) String() string {
+	names := make([]string, len(*l))
+	for i, f := range *l {
+		names[i] = f.Filename
+	}
+	return strings.Join(names, " ")
+}
+
+// Set parses a sound effect definition of the form
+// file.vgm[,name=NAME][,priority=0-15][,channels=1234].
+func (l *SoundEffectFileList) Set(value string) error {
+	fields := strings.Split(value, ",")
+	f := SoundEffectFile{
+		Filename: fields[0],
+	}
+	f.Name = defaultName(f.Filename)
+	for _, field := range fields[1:] {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("invalid sound effect option %q", field)
+		}
+		switch key {
+		case "name":
+			f.Name = val
+		case "priority":
+			v, err := strconv.ParseUint(val, 10, 8)
+			if err != nil || v > 15 {
+				return fmt.Errorf("invalid priority %q", val)
+			}
+			f.Priority = uint8(v)
+		case "channels":
+			v, ok := parseChannelList(val)
+			if !ok || v == 0 {
+				return fmt.Errorf("invalid channel list %q", val)
+			}
+			f.Channels = v
+		default:
+			return fmt.Errorf("unknown sound effect option %q", key)
+		}
+	}
+	*l = append(*l, &f)
+	return nil
+}
+
+// ConvertSoundEffectFile loads a VGM file as a sound effect.
+func ConvertSoundEffectFile(f *SoundEffectFile) (*SoundEffect, error) {
+	file, err := os.Open(f.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	song, err := parseVGM(file, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Filename, err)
+	}
+	if len(song.Samples) > 0 {
+		return nil, fmt.Errorf("%s: sound effects cannot use PCM samples", f.Filename)
+	}
+	song.Name = f.Name
+	song.LoopCount = 0
+	MuteChannels(song, MutedChannels)
+	song.printDropped(f.Filename)
+	ValidateSong(song).print(f.Filename)
+
+	usedChannels := songChannels(song)
+	channels := f.Channels
+	if channels == 0 {
+		channels = usedChannels
+	} else if (usedChannels &^ channels) != 0 {
+		return nil, fmt.Errorf("%s: sound effect uses undeclared channels (mask %X)", f.Filename, usedChannels&^channels)
+	}
+
+	return &SoundEffect{
+		Name:     f.Name,
+		Song:     song,
+		Priority: f.Priority,
+		Channels: channels,
+	}, nil
+}
+
+// tableInfo returns the final byte of the sound effect's table entry.
+func (s *SoundEffect) tableInfo() uint8 {
+	return (s.Priority << 4) | (s.Channels & 0x0F)
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/asiekierka/vgmswan/v2/converter/vgm"
+)
+
+const (
+	vgmCommandGameGearStereo  = 0x4F
+	vgmCommandSN76489         = 0x50
+	vgmCommandGameGearStereo2 = 0x3F
+	vgmCommandSN76489Chip2    = 0x30
+	// the top two bits of the clock select the T6W28 and dual chip modes
+	sn76489ClockMask = 0x3FFFFFFF
+)
+
+// sn76489Translator maps the three SN76489 tone channels onto WonderSwan
+// channels 1-3 with square waves, and its noise channel onto channel 4.
+type sn76489Translator struct {
+	translationReport
+	clock      float64
+	flags      uint8
+	shiftWidth uint8
+	tone       [3]uint16
+	// attenuation, in 2dB steps
+	volume [4]uint8
+	noise  uint8
+	stereo uint8
+	// latched channel (bits 1-2) and register type (bit 0, set for volume)
+	latch uint8
+}
+
+func newSN76489Translator(header *vgm.VGMHeader) *sn76489Translator {
+	t := sn76489Translator{
+		clock:      float64(header.ClockSN76489 & sn76489ClockMask),
+		flags:      header.FlagsSN76489,
+		shiftWidth: header.ShiftRegisterWidthSN76489,
+		volume:     [4]uint8{0x0F, 0x0F, 0x0F, 0x0F},
+		stereo:     0xFF,
+	}
+	if t.shiftWidth == 0 {
+		t.shiftWidth = 16
+	}
+	return &t
+}
+
+func (t *sn76489Translator) write(value uint8) {
+	if (value & 0x80) != 0 {
+		t.latch = (value >> 4) & 0x07
+	}
+	ch := t.latch >> 1
+	switch {
+	case (t.latch & 0x01) != 0:
+		t.volume[ch] = value & 0x0F
+	case ch == 3:
+		t.noise = value & 0x07
+	case (value & 0x80) != 0:
+		t.tone[ch] = (t.tone[ch] &^ 0x0F) | uint16(value&0x0F)
+	default:
+		t.tone[ch] = (t.tone[ch] & 0x0F) | (uint16(value&0x3F) << 4)
+	}
+}
+
+func (t *sn76489Translator) command(cmd uint8, r io.Reader) (bool, error) {
+	var value uint8
+	switch cmd {
+	case vgmCommandSN76489:
+		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+			return true, err
+		}
+		t.write(value)
+	case vgmCommandGameGearStereo:
+		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+			return true, err
+		}
+		if (t.flags & vgm.VGM_SN76489_GAME_GEAR_MONO) == 0 {
+			t.stereo = value
+		}
+	case vgmCommandSN76489Chip2, vgmCommandGameGearStereo2:
+		// only the first chip is translated
+		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+			return true, err
+		}
+		t.drop("second chip")
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// period returns a tone channel's period register, in units of 16 clocks.
+func (t *sn76489Translator) period(ch int) float64 {
+	if t.tone[ch] == 0 && (t.flags&vgm.VGM_SN76489_FREQ_0_IS_0x400) != 0 {
+		return 0x400
+	}
+	return float64(t.tone[ch])
+}
+
+func (t *sn76489Translator) setVolume(ws *wsShadow, ch int) {
+	// 2dB per attenuation step; the last step is silence
+	amplitude := 0.0
+	if t.volume[ch] < 0x0F {
+		amplitude = math.Pow(10, -0.1*float64(t.volume[ch]))
+	}
+	left, right := amplitude, amplitude
+	if (t.stereo & (0x10 << ch)) == 0 {
+		left = 0
+	}
+	if (t.stereo & (0x01 << ch)) == 0 {
+		right = 0
+	}
+	ws.setVolume(ch, left, right)
+}
+
+func (t *sn76489Translator) update(ws *wsShadow) {
+	var square, pulse [wsWaveLength]uint8
+	for i := 0; i < wsWaveLength/2; i++ {
+		square[i] = 0x0F
+	}
+	for i := 0; i < wsWaveLength/int(t.shiftWidth); i++ {
+		pulse[i] = 0x0F
+	}
+
+	for ch := 0; ch < 3; ch++ {
+		ws.setWave(ch, &square)
+		if t.period(ch) > 0 {
+			ws.setFrequency(ch, t.clock/(32*t.period(ch)))
+			t.setVolume(ws, ch)
+		} else {
+			// a period of zero is a constant level; leave it silent
+			ws.setVolume(ch, 0, 0)
+		}
+	}
+
+	// the noise shift register steps at a fixed rate, or with tone channel 3
+	shiftRate := 0.0
+	if (t.noise & 0x03) == 0x03 {
+		if t.period(2) > 0 {
+			shiftRate = t.clock / (32 * t.period(2))
+		}
+	} else {
+		shiftRate = t.clock / float64(int(512)<<(t.noise&0x03))
+	}
+	chCtrl := uint8(0x0F)
+	if (t.noise & 0x04) != 0 {
+		// white noise
+		ws.setRate(3, shiftRate)
+		ws.ports[portNoiseCtrl] = 0x10
+		chCtrl |= chCtrlNoise
+	} else {
+		// periodic noise is a pulse wave, one shift register cycle long
+		ws.setWave(3, &pulse)
+		ws.setFrequency(3, shiftRate/float64(t.shiftWidth))
+		ws.ports[portNoiseCtrl] = 0x00
+	}
+	t.setVolume(ws, 3)
+	ws.ports[portChCtrl] = chCtrl
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/asiekierka/vgmswan/v2/converter/vgm"
+)
+
+func TestSN76489Translator(t *testing.T) {
+	// tone channel 1 at period 0xFE: 3579545 / (32 * 254) Hz
+	tone := []byte{vgmCommandSN76489, 0x8E, vgmCommandSN76489, 0x0F}
+	tests := []struct {
+		name        string
+		flags       uint8
+		commands    []byte
+		want        map[uint8]uint8
+		wantDropped map[string]int
+	}{
+		{
+			"tone",
+			0,
+			concat(tone, []byte{vgmCommandSN76489, 0x90}),
+			map[uint8]uint8{portFreqCh1: 0x26, portFreqCh1 + 1: 0x07, portVolCh1: 0xFF, portVolCh1 + 1: 0x00, portChCtrl: 0x0F},
+			nil,
+		},
+		{
+			"attenuation",
+			0,
+			concat(tone, []byte{vgmCommandSN76489, 0x93}),
+			map[uint8]uint8{portVolCh1: 0x88},
+			nil,
+		},
+		{
+			"silent channel",
+			0,
+			concat(tone, []byte{vgmCommandSN76489, 0x9F}),
+			map[uint8]uint8{portVolCh1: 0x00},
+			nil,
+		},
+		{
+			"Game Gear stereo",
+			0,
+			concat(tone, []byte{vgmCommandSN76489, 0x90, vgmCommandGameGearStereo, 0x10}),
+			map[uint8]uint8{portVolCh1: 0xF0},
+			nil,
+		},
+		{
+			"Game Gear stereo on a mono chip",
+			vgm.VGM_SN76489_GAME_GEAR_MONO,
+			concat(tone, []byte{vgmCommandSN76489, 0x90, vgmCommandGameGearStereo, 0x10}),
+			map[uint8]uint8{portVolCh1: 0xFF},
+			nil,
+		},
+		{
+			"period zero is 0x400",
+			vgm.VGM_SN76489_FREQ_0_IS_0x400,
+			[]byte{vgmCommandSN76489, 0x80, vgmCommandSN76489, 0x00, vgmCommandSN76489, 0x90},
+			map[uint8]uint8{portFreqCh1: 0x91, portFreqCh1 + 1: 0x04, portVolCh1: 0xFF},
+			nil,
+		},
+		{
+			"white noise",
+			0,
+			[]byte{vgmCommandSN76489, 0xE4, vgmCommandSN76489, 0xF0},
+			map[uint8]uint8{portFreqCh1 + 6: 0x49, portFreqCh1 + 7: 0x06, portVolCh1 + 3: 0xFF, portNoiseCtrl: 0x10, portChCtrl: 0x8F},
+			nil,
+		},
+		{
+			"second chip",
+			0,
+			[]byte{vgmCommandSN76489Chip2, 0x90, vgmCommandGameGearStereo2, 0x00},
+			map[uint8]uint8{portVolCh1: 0x00},
+			map[string]int{"second chip": 2},
+		},
+	}
+	for _, tt := range tests {
+		translator := newSN76489Translator(&vgm.VGMHeader{ClockSN76489: 3579545, FlagsSN76489: tt.flags})
+		ws := runTranslator(t, translator, tt.commands)
+		checkPorts(t, tt.name, ws, tt.want)
+		checkDropped(t, tt.name, translator, tt.wantDropped)
+	}
+}
+
+func TestSN76489TranslatorTruncated(t *testing.T) {
+	translator := newSN76489Translator(&vgm.VGMHeader{ClockSN76489: 3579545})
+	for _, cmd := range []uint8{vgmCommandSN76489, vgmCommandGameGearStereo, vgmCommandSN76489Chip2} {
+		if ok, err := translator.command(cmd, bytes.NewReader(nil)); !ok || err == nil {
+			t.Errorf("command %02X: got %v, %v, want an error", cmd, ok, err)
+		}
+	}
+	if ok, err := translator.command(vgmCommandDMG, bytes.NewReader(nil)); ok || err != nil {
+		t.Errorf("foreign command: got %v, %v, want it to be left alone", ok, err)
+	}
+}
+
+func TestParseVGMSN76489(t *testing.T) {
+	defer func(v bool, w int) { HBlankTiming, WaveBase = v, w }(HBlankTiming, WaveBase)
+	HBlankTiming, WaveBase = true, -1
+
+	commands := concat([]byte{vgmCommandSN76489, 0x8E, vgmCommandSN76489, 0x0F, vgmCommandSN76489, 0x90}, vgmWait(441))
+	song, err := parseVGM(testVGM(map[int]uint32{0x0C: 3579545}, commands, -1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var writes []string
+	waits := uint32(0)
+	for _, frame := range song.Commands {
+		for _, cmdRaw := range frame.Commands {
+			switch cmd := cmdRaw.(type) {
+			case *CommandWritePort:
+				writes = append(writes, fmt.Sprintf("%02X:% X", cmd.Address, cmd.Data))
+			case *CommandWait:
+				waits += cmd.Length
+			}
+		}
+	}
+	for _, want := range []string{"00:26 07", "08:FF 00", "10:0F"} {
+		found := false
+		for _, write := range writes {
+			found = found || write == want
+		}
+		if !found {
+			t.Errorf("port writes %q do not include %q", writes, want)
+		}
+	}
+	if waits != 120 {
+		t.Errorf("waits: got %d, want 120", waits)
+	}
+}
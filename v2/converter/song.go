@@ -0,0 +1,273 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/asiekierka/vgmswan/v2/converter/vgm"
+)
+
+// Loop count which causes a song to loop forever.
+const LoopForever = -1
+
+// SongFile describes a VGM or MIDI file converted as a song.
+type SongFile struct {
+	Name               string
+	Filename           string
+	LoopCount          *int
+	MarkerFilename     string
+	InstrumentFilename string
+	Mute               uint8
+	Volume             float64
+	Stereo             int
+	Pan                [4]int
+	FadeOut            float64
+	Tempo              float64
+}
+
+// defaultName derives the name of a song or sample from its filename.
+func defaultName(filename string) string {
+	return strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+}
+
+// NewSongFile creates a song description, using the global options as
+// defaults.
+func NewSongFile(filename string) *SongFile {
+	return &SongFile{
+		Filename:           filename,
+		InstrumentFilename: InstrumentFilename,
+		Mute:               MutedChannels,
+		Volume:             VolumeScale,
+		Stereo:             StereoMode,
+		Pan:                PanOffsets,
+		FadeOut:            FadeOutSeconds,
+		Tempo:              1.0,
+	}
+}
+
+// parseLoopCount parses a loop count: "forever", "none" or a number of
+// jumps back to the loop point before stopping.
+func parseLoopCount(value string) (int, error) {
+	switch value {
+	case "forever":
+		return LoopForever, nil
+	case "none":
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(value, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid loop count %q", value)
+	}
+	return int(v), nil
+}
+
+// ParseSongFile parses a song argument of the form
+// file.vgm[,name=NAME][,loop=forever|none|COUNT][,markers=FILE][,mute=1234]
+// [,volume=SCALE][,stereo=stereo|mono|swap][,pan=L1:L2:L3:L4]
+// [,fade-out=SECONDS][,tempo=SCALE][,instruments=FILE].
+func ParseSongFile(value string) (*SongFile, error) {
+	fields := strings.Split(value, ",")
+	f := NewSongFile(fields[0])
+	for _, field := range fields[1:] {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid song option %q", field)
+		}
+		switch key {
+		case "loop":
+			v, err := parseLoopCount(val)
+			if err != nil {
+				return nil, err
+			}
+			f.LoopCount = &v
+		case "markers":
+			f.MarkerFilename = val
+		case "instruments":
+			f.InstrumentFilename = val
+		case "name":
+			f.Name = val
+		case "mute":
+			v, ok := parseChannelList(val)
+			if !ok {
+				return nil, fmt.Errorf("invalid channel list %q", val)
+			}
+			f.Mute = v
+		case "stereo":
+			v, err := parseStereoMode(val)
+			if err != nil {
+				return nil, err
+			}
+			f.Stereo = v
+		case "pan":
+			v, err := parsePanOffsets(val)
+			if err != nil {
+				return nil, err
+			}
+			f.Pan = v
+		case "volume", "fade-out", "tempo":
+			v, err := strconv.ParseFloat(val, 64)
+			if err != nil || v < 0 || (key == "tempo" && v == 0) {
+				return nil, fmt.Errorf("invalid %s %q", key, val)
+			}
+			switch key {
+			case "volume":
+				f.Volume = v
+			case "fade-out":
+				f.FadeOut = v
+			case "tempo":
+				f.Tempo = v
+			}
+		default:
+			return nil, fmt.Errorf("unknown song option %q", key)
+		}
+	}
+	return f, nil
+}
+
+// LoadSong reads and converts a song.
+func LoadSong(f *SongFile) (*Song, error) {
+	songReader, err := os.Open(f.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer songReader.Close()
+
+	var markers []Marker
+	if len(f.MarkerFilename) > 0 {
+		markers, err = ReadMarkerFile(f.MarkerFilename)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	isMIDI := isMIDIFile(songReader)
+	var song *Song
+	if isMIDI {
+		if len(f.InstrumentFilename) <= 0 {
+			return nil, fmt.Errorf("%s: MIDI songs need an instrument file", f.Filename)
+		}
+		instruments, err := ReadInstrumentFile(f.InstrumentFilename)
+		if err != nil {
+			return nil, err
+		}
+		song, err = parseMIDI(songReader, instruments, markers)
+	} else {
+		song, err = parseVGM(songReader, markers)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Filename, err)
+	}
+	song.Name = f.Name
+	if len(song.Name) <= 0 && UseGD3Names && !isMIDI {
+		songReader.Seek(0, io.SeekStart)
+		header, err := vgm.ReadVGMHeader(songReader)
+		if err != nil {
+			return nil, err
+		}
+		tag, err := vgm.ReadGD3Tag(songReader, header)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Filename, err)
+		}
+		if tag != nil {
+			song.Name = tag.TrackName
+		}
+	}
+	if len(song.Name) <= 0 {
+		song.Name = defaultName(f.Filename)
+	}
+	if f.LoopCount != nil {
+		song.LoopCount = *f.LoopCount
+	}
+	MuteChannels(song, f.Mute)
+	ScaleVolume(song, f.Volume)
+	PanVolume(song, f.Stereo, f.Pan)
+	if err := ScaleTempo(song, f.Tempo); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Filename, err)
+	}
+	if f.FadeOut > 0 {
+		FadeOut(song, f.FadeOut)
+	}
+	song.printDropped(f.Filename)
+	ValidateSong(song).print(f.Filename)
+	return song, nil
+}
+
+// printDropped warns about parts of a song which were not converted.
+func (s *Song) printDropped(name string) {
+	if s.DroppedMarkers > 0 {
+		fmt.Fprintf(os.Stderr, "%s: warning: %d markers past the end of the song dropped\n", name, s.DroppedMarkers)
+	}
+	if s.DroppedWaveWrites > 0 {
+		fmt.Fprintf(os.Stderr, "%s: warning: %d memory writes outside of the wavetables dropped\n", name, s.DroppedWaveWrites)
+	}
+}
+
+// ScaleTempo speeds up (tempo > 1) or slows down (tempo < 1) a song by
+// scaling all of its waits. Every wait is kept at least one unit long, with
+// rounding errors carried over to the following waits.
+func ScaleTempo(song *Song, tempo float64) error {
+	if tempo <= 0 || math.IsNaN(tempo) {
+		return fmt.Errorf("invalid tempo %v", tempo)
+	}
+	if tempo == 1.0 {
+		return nil
+	}
+	scaled := 0.0
+	written := 0.0
+	for _, frame := range song.Commands {
+		for i, cmdRaw := range frame.Commands {
+			if cmd, ok := cmdRaw.(*CommandWait); ok {
+				scaled += float64(cmd.Length) / tempo
+				length := math.Min(math.Max(math.Round(scaled-written), 1), 0xFFFF)
+				written += length
+				frame.Commands[i] = &CommandWait{uint32(length)}
+			}
+		}
+	}
+	return nil
+}
+
+// defaultLoopCount derives the loop count of a song from its VGM header.
+func defaultLoopCount(header *vgm.VGMHeader) int {
+	if header.LoopOffset == 0 {
+		return 0
+	}
+	if header.LoopBase == 0 && header.LoopModifier == 0 {
+		return LoopForever
+	}
+	modifier := int(header.LoopModifier)
+	if modifier == 0 {
+		modifier = 0x10
+	}
+	// the VGM specification assumes two playthroughs of the loop by default
+	plays := (2*modifier+8)/0x10 - int(int8(header.LoopBase))
+	if plays <= 1 {
+		return 0
+	}
+	return plays - 1
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/asiekierka/vgmswan/v2/converter/vgm"
+)
+
+func TestDefaultLoopCount(t *testing.T) {
+	tests := []struct {
+		offset   uint32
+		base     uint8
+		modifier uint8
+		want     int
+	}{
+		{0, 0, 0, 0},
+		{0, 0x20, 0x20, 0},
+		{0x40, 0, 0, LoopForever},
+		// two playthroughs by default
+		{0x40, 0xFF, 0, 2},
+		{0x40, 0, 0x10, 1},
+		{0x40, 0, 0x20, 3},
+		{0x40, 1, 0x10, 0},
+		{0x40, 0xFF, 0x10, 2},
+		{0x40, 4, 0x10, 0},
+	}
+	for _, tt := range tests {
+		header := &vgm.VGMHeader{LoopOffset: tt.offset, LoopBase: tt.base, LoopModifier: tt.modifier}
+		if got := defaultLoopCount(header); got != tt.want {
+			t.Errorf("offset %X, base %02X, modifier %02X: got %d, want %d", tt.offset, tt.base, tt.modifier, got, tt.want)
+		}
+	}
+}
+
+func TestParseLoopCount(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"forever", LoopForever, false},
+		{"none", 0, false},
+		{"0", 0, false},
+		{"3", 3, false},
+		{"255", 255, false},
+		{"256", 0, true},
+		{"-1", 0, true},
+		{"twice", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseLoopCount(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v, want error %v", tt.value, err, tt.wantErr)
+		} else if got != tt.want {
+			t.Errorf("%q: got %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCommandFrameCallable(t *testing.T) {
+	tests := []struct {
+		commands []interface{}
+		want     bool
+	}{
+		{nil, false},
+		{[]interface{}{&CommandWait{1}}, true},
+		{[]interface{}{&CommandWritePort{portChCtrl, []byte{0}}, &CommandWait{1}}, true},
+		// frames split at the loop offset may end without a wait
+		{[]interface{}{&CommandWait{1}, &CommandWritePort{portChCtrl, []byte{0}}}, false},
+	}
+	for i, tt := range tests {
+		frame := &CommandFrame{Commands: tt.commands}
+		if got := frame.Callable(); got != tt.want {
+			t.Errorf("frame %d: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestScaleTempo(t *testing.T) {
+	tests := []struct {
+		tempo float64
+		waits []uint32
+		want  []uint32
+	}{
+		{1, []uint32{10, 10, 10}, []uint32{10, 10, 10}},
+		// rounding errors are carried over to later waits
+		{3, []uint32{10, 10, 10}, []uint32{3, 4, 3}},
+		{0.5, []uint32{10, 20}, []uint32{20, 40}},
+		// waits never shrink to zero or grow past 16 bits
+		{2, []uint32{1, 1, 1}, []uint32{1, 1, 1}},
+		{0.5, []uint32{0xFFFF}, []uint32{0xFFFF}},
+	}
+	for _, tt := range tests {
+		commands := make([]interface{}, len(tt.waits))
+		for i, length := range tt.waits {
+			commands[i] = &CommandWait{length}
+		}
+		song := testSong(-1, 0, commands)
+		if err := ScaleTempo(song, tt.tempo); err != nil {
+			t.Errorf("tempo %v: unexpected error %v", tt.tempo, err)
+			continue
+		}
+		for i, cmdRaw := range song.Commands[0].Commands {
+			if got := cmdRaw.(*CommandWait).Length; got != tt.want[i] {
+				t.Errorf("tempo %v, wait %d: got %d, want %d", tt.tempo, i, got, tt.want[i])
+			}
+		}
+	}
+	for _, tempo := range []float64{0, -1, math.NaN()} {
+		if err := ScaleTempo(testSong(-1, 0), tempo); err == nil {
+			t.Errorf("tempo %v: expected an error", tempo)
+		}
+	}
+}
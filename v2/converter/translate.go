@@ -0,0 +1,218 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/asiekierka/vgmswan/v2/converter/vgm"
+)
+
+// wsClock is the WonderSwan sound clock, in Hz.
+const wsClock = 3072000
+
+// wsWaveLength is the amount of 4-bit samples in a channel's wavetable.
+const wsWaveLength = 32
+
+// chipTranslator converts a song written for another sound chip into
+// WonderSwan register writes.
+type chipTranslator interface {
+	// command handles the VGM command cmd, reading its operands from r; it
+	// returns false if the command does not belong to the chip.
+	command(cmd uint8, r io.Reader) (bool, error)
+	// update sets the WonderSwan state matching the chip's current state.
+	update(ws *wsShadow)
+	// dropped returns the features which could not be translated.
+	dropped() *translationReport
+}
+
+// translationReport counts the writes to chip features a translation had to
+// drop.
+type translationReport struct {
+	counts map[string]int
+}
+
+// drop records a write to a feature which could not be translated.
+func (r *translationReport) drop(feature string) {
+	if r.counts == nil {
+		r.counts = make(map[string]int)
+	}
+	r.counts[feature]++
+}
+
+func (r *translationReport) dropped() *translationReport {
+	return r
+}
+
+// print lists the dropped features, if any.
+func (r *translationReport) print() {
+	features := make([]string, 0, len(r.counts))
+	for feature := range r.counts {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	for _, feature := range features {
+		fmt.Printf("translation dropped %s (%d writes)\n", feature, r.counts[feature])
+	}
+}
+
+// timedTranslator is a chipTranslator for a chip which changes its own state
+// over time, such as through envelopes.
+type timedTranslator interface {
+	chipTranslator
+	// untilTick returns the amount of VGM samples until the chip's state
+	// next changes on its own, or 0 if it will not.
+	untilTick() uint32
+	// advance moves the chip forward by an amount of VGM samples.
+	advance(samples uint32)
+}
+
+// waitUnits converts a VGM sample position to wait units.
+func waitUnits(samplePos uint32) uint32 {
+	lines := (uint64(samplePos)*120 + 220) / 441
+	if !HBlankTiming {
+		return uint32((lines + 79) / 159)
+	}
+	return uint32(lines)
+}
+
+// newChipTranslator returns a translator for the first supported chip used
+// by a song, or nil if there is none.
+func newChipTranslator(header *vgm.VGMHeader) chipTranslator {
+	if header.ClockSN76489 != 0 {
+		return newSN76489Translator(header)
+	}
+	if header.ClockDMG != 0 {
+		return newDMGTranslator(header)
+	}
+	if header.ClockHUC6280 != 0 {
+		return newHuC6280Translator(header)
+	}
+	if header.ClockAY8910 != 0 {
+		return newAY8910Translator(header)
+	}
+	return nil
+}
+
+// wsShadow holds the WonderSwan sound state a translated song should be in,
+// so that only changes need to be written.
+type wsShadow struct {
+	ports     [0x20]uint8
+	wave      [0x40]uint8
+	lastPorts [0x20]uint8
+	lastWave  [0x40]uint8
+	written   bool
+	// mode ports changed while their mode was off, written once it is on
+	deferred [0x20]bool
+}
+
+// wsShadowPorts lists the ports written by translated songs, in order; the
+// channel control port comes last, so channels are set up before enabling.
+var wsShadowPorts = []uint8{
+	portFreqCh1, portFreqCh1 + 2, portFreqCh1 + 4, portFreqCh1 + 6,
+	portVolCh1, portVolCh1 + 1, portVolCh1 + 2, portVolCh1 + 3,
+	portSweepValue, portSweepTime, portNoiseCtrl, portVoiceVolume,
+	portChCtrl,
+}
+
+// setRate sets a channel's frequency register for the given amount of
+// wavetable samples (or noise steps) per second.
+func (s *wsShadow) setRate(ch int, rate float64) {
+	value := 0.0
+	if rate > 0 {
+		value = math.Round(2048 - wsClock/rate)
+	}
+	reg := uint16(math.Max(0, math.Min(value, 2047)))
+	s.ports[portFreqCh1+ch*2] = uint8(reg)
+	s.ports[portFreqCh1+ch*2+1] = uint8(reg >> 8)
+}
+
+// setFrequency sets a channel's tone frequency, in Hz.
+func (s *wsShadow) setFrequency(ch int, hz float64) {
+	s.setRate(ch, hz*wsWaveLength)
+}
+
+// setVolume sets a channel's volume from left and right amplitudes in the
+// 0.0 .. 1.0 range.
+func (s *wsShadow) setVolume(ch int, left float64, right float64) {
+	s.ports[portVolCh1+ch] = uint8(math.Round(math.Max(0, math.Min(left, 1))*15))<<4 |
+		uint8(math.Round(math.Max(0, math.Min(right, 1))*15))
+}
+
+// setWave sets a channel's wavetable from 32 samples in the 0 .. 15 range.
+func (s *wsShadow) setWave(ch int, samples *[wsWaveLength]uint8) {
+	for i := 0; i < wsWaveLength; i += 2 {
+		s.wave[ch*16+i/2] = (samples[i] & 0x0F) | (samples[i+1] << 4)
+	}
+}
+
+// appendPort appends a write of value to port, merging it with a preceding
+// single byte write to the port before it.
+func appendPort(frame *CommandFrame, port uint8, value uint8) {
+	if len(frame.Commands) > 0 {
+		if cmd, ok := frame.Commands[len(frame.Commands)-1].(*CommandWritePort); ok && len(cmd.Data) == 1 && cmd.Address == port-1 {
+			cmd.Data = append(cmd.Data, value)
+			return
+		}
+	}
+	frame.Commands = append(frame.Commands, &CommandWritePort{port, []byte{value}})
+}
+
+// invalidate makes the next emit write the whole state.
+func (s *wsShadow) invalidate() {
+	s.written = false
+}
+
+// emit appends the writes needed to bring the hardware to the shadow state.
+func (s *wsShadow) emit(frame *CommandFrame) {
+	if !s.written && WaveBase >= 0 {
+		frame.Commands = append(frame.Commands, &CommandWritePort{portWaveBase, []byte{uint8(WaveBase >> 6)}})
+	}
+	for i := 0; i < len(s.wave); i += 16 {
+		if !s.written || !bytes.Equal(s.wave[i:i+16], s.lastWave[i:i+16]) {
+			data := make([]byte, 16)
+			copy(data, s.wave[i:i+16])
+			frame.Commands = append(frame.Commands, &CommandWriteMemory{uint16(i), data})
+		}
+	}
+	for _, port := range wsShadowPorts {
+		if port < portVolCh1 {
+			// frequencies are written as words
+			if !s.written || s.ports[port] != s.lastPorts[port] || s.ports[port+1] != s.lastPorts[port+1] {
+				frame.Commands = append(frame.Commands, &CommandWritePort{port, []byte{s.ports[port], s.ports[port+1]}})
+			}
+		} else if !s.written || s.ports[port] != s.lastPorts[port] || s.deferred[port] {
+			if mode := portMode(port); s.ports[portChCtrl]&mode != mode {
+				s.deferred[port] = true
+				continue
+			}
+			appendPort(frame, port, s.ports[port])
+			s.deferred[port] = false
+		}
+	}
+	s.lastPorts = s.ports
+	s.lastWave = s.wave
+	s.written = true
+}
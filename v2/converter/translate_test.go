@@ -0,0 +1,163 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// runTranslator feeds VGM commands to a translator and returns the
+// WonderSwan state it translates them to.
+func runTranslator(t *testing.T, translator chipTranslator, commands []byte) *wsShadow {
+	t.Helper()
+	r := bytes.NewReader(commands)
+	for r.Len() > 0 {
+		cmd, _ := r.ReadByte()
+		ok, err := translator.command(cmd, r)
+		if err != nil {
+			t.Fatalf("command %02X: %v", cmd, err)
+		} else if !ok {
+			t.Fatalf("command %02X not handled", cmd)
+		}
+	}
+	var ws wsShadow
+	translator.update(&ws)
+	return &ws
+}
+
+// checkPorts compares the given ports of a WonderSwan state.
+func checkPorts(t *testing.T, name string, ws *wsShadow, want map[uint8]uint8) {
+	t.Helper()
+	for port, value := range want {
+		if ws.ports[port] != value {
+			t.Errorf("%s: port %02X is %02X, want %02X", name, port, ws.ports[port], value)
+		}
+	}
+}
+
+// checkDropped compares the dropped feature counts of a translator or MIDI
+// converter.
+func checkDropped(t *testing.T, name string, translator interface{ dropped() *translationReport }, want map[string]int) {
+	t.Helper()
+	got := translator.dropped().counts
+	if len(got) != len(want) {
+		t.Errorf("%s: dropped %v, want %v", name, got, want)
+		return
+	}
+	for feature, count := range want {
+		if got[feature] != count {
+			t.Errorf("%s: dropped %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+// describeCommands formats commands for test failure messages.
+func describeCommands(commands []interface{}) []string {
+	result := make([]string, len(commands))
+	for i, cmd := range commands {
+		result[i] = fmt.Sprintf("%+v", cmd)
+	}
+	return result
+}
+
+func TestWaitUnits(t *testing.T) {
+	defer func(v bool) { HBlankTiming = v }(HBlankTiming)
+	tests := []struct {
+		hblank    bool
+		samplePos uint32
+		want      uint32
+	}{
+		{true, 0, 0},
+		{true, 441, 120},
+		{true, 44100, 12000},
+		// rounded to the nearest line
+		{true, 2, 1},
+		{true, 1, 0},
+		{false, 44100, 75},
+		{false, 441 * 159 / 120, 1},
+	}
+	for _, tt := range tests {
+		HBlankTiming = tt.hblank
+		if got := waitUnits(tt.samplePos); got != tt.want {
+			t.Errorf("hblank %v, %d samples: got %d, want %d", tt.hblank, tt.samplePos, got, tt.want)
+		}
+	}
+}
+
+func TestWSShadowEmit(t *testing.T) {
+	defer func(v int) { WaveBase = v }(WaveBase)
+	WaveBase = -1
+
+	var ws wsShadow
+	var square [wsWaveLength]uint8
+	for i := 0; i < wsWaveLength/2; i++ {
+		square[i] = 0x0F
+	}
+	ws.setWave(1, &square)
+	ws.setRate(0, 96000)
+	ws.setVolume(0, 1, 0.5)
+	ws.ports[portNoiseCtrl] = 0x10
+	ws.ports[portChCtrl] = 0x0F
+
+	frame := &CommandFrame{}
+	ws.emit(frame)
+	wave := append(bytes.Repeat([]byte{0xFF}, 8), make([]byte, 8)...)
+	want := []interface{}{
+		&CommandWriteMemory{0x00, make([]byte, 16)},
+		&CommandWriteMemory{0x10, wave},
+		&CommandWriteMemory{0x20, make([]byte, 16)},
+		&CommandWriteMemory{0x30, make([]byte, 16)},
+		&CommandWritePort{portFreqCh1, []byte{0xE0, 0x07}},
+		&CommandWritePort{portFreqCh1 + 2, []byte{0x00, 0x00}},
+		&CommandWritePort{portFreqCh1 + 4, []byte{0x00, 0x00}},
+		&CommandWritePort{portFreqCh1 + 6, []byte{0x00, 0x00}},
+		// the noise and sweep settings wait for their modes to be enabled
+		&CommandWritePort{portVolCh1, []byte{0xF8, 0x00}},
+		&CommandWritePort{portVolCh1 + 2, []byte{0x00, 0x00}},
+		&CommandWritePort{portChCtrl, []byte{0x0F}},
+	}
+	if !reflect.DeepEqual(frame.Commands, want) {
+		t.Errorf("first emit: got %v, want %v", describeCommands(frame.Commands), describeCommands(want))
+	}
+
+	frame = &CommandFrame{}
+	ws.emit(frame)
+	if len(frame.Commands) != 0 {
+		t.Errorf("unchanged emit: got %v, want nothing", describeCommands(frame.Commands))
+	}
+
+	frame = &CommandFrame{}
+	ws.ports[portChCtrl] = 0x0F | chCtrlNoise
+	ws.setVolume(1, 0, 1)
+	ws.emit(frame)
+	want = []interface{}{
+		&CommandWritePort{portVolCh1 + 1, []byte{0x0F}},
+		&CommandWritePort{portNoiseCtrl, []byte{0x10}},
+		&CommandWritePort{portChCtrl, []byte{0x8F}},
+	}
+	if !reflect.DeepEqual(frame.Commands, want) {
+		t.Errorf("changed emit: got %v, want %v", describeCommands(frame.Commands), describeCommands(want))
+	}
+}
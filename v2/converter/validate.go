@@ -0,0 +1,169 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Noise control (port 0x8E) bits.
+const (
+	noiseCtrlTap    = 0x07
+	noiseCtrlReset  = 0x08
+	noiseCtrlEnable = 0x10
+)
+
+// validationReport counts problems found in a converted song.
+type validationReport struct {
+	counts map[string]int
+}
+
+func (r *validationReport) warn(format string, args ...interface{}) {
+	if r.counts == nil {
+		r.counts = make(map[string]int)
+	}
+	r.counts[fmt.Sprintf(format, args...)]++
+}
+
+// print lists the problems found, if any.
+func (r *validationReport) print(name string) {
+	problems := make([]string, 0, len(r.counts))
+	for problem := range r.counts {
+		problems = append(problems, problem)
+	}
+	sort.Strings(problems)
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s (%d times)\n", name, problem, r.counts[problem])
+	}
+}
+
+// songValidator models the sound hardware's channel modes while walking a
+// song, to find writes which cannot have the intended effect.
+type songValidator struct {
+	validationReport
+	chCtrl uint8
+	// ports written while their channel, or its mode, was off; a second
+	// write before it is turned on means the first had no effect
+	unused map[uint8]bool
+	// a sample was started in the current frame
+	samplePlayed bool
+}
+
+// portEnabled returns the channel control bits a port's writes depend on,
+// and a description of them.
+func portEnabled(addr uint8) (uint8, string) {
+	switch {
+	case addr < portVolCh1:
+		ch := addr >> 1
+		return 1 << ch, fmt.Sprintf("frequency write to disabled channel %d", ch+1)
+	case addr < portSweepValue:
+		ch := addr - portVolCh1
+		return 1 << ch, fmt.Sprintf("volume write to disabled channel %d", ch+1)
+	case addr == portSweepValue || addr == portSweepTime:
+		return portMode(addr), "sweep write while channel 3 is not in sweep mode"
+	case addr == portNoiseCtrl:
+		return portMode(addr), "noise control write while channel 4 is not in noise mode"
+	case addr == portVoiceVolume:
+		return portMode(addr), "voice volume write while channel 2 is not in voice mode"
+	default:
+		return 0, ""
+	}
+}
+
+// writePort checks a single port write.
+func (v *songValidator) writePort(addr uint8, value uint8) {
+	switch {
+	case addr == portChCtrl:
+		v.chCtrl = value
+		for port := range v.unused {
+			if bits, _ := portEnabled(port); v.chCtrl&bits == bits {
+				delete(v.unused, port)
+			}
+		}
+		return
+	case addr == portSweepTime && value > 0x1F:
+		v.warn("sweep time %02X out of range", value)
+	case addr == portNoiseCtrl && value&^(noiseCtrlTap|noiseCtrlReset|noiseCtrlEnable) != 0:
+		v.warn("noise control %02X sets unused bits", value)
+	case addr == portVoiceVolume && value > 0x0F:
+		v.warn("voice volume %02X sets unused bits", value)
+	case addr > portChCtrl && addr != portVoiceVolume:
+		v.warn("write to port %02X, which the engine does not expect", 0x80+int(addr))
+		return
+	}
+	bits, problem := portEnabled(addr)
+	if bits == 0 {
+		return
+	}
+	if v.chCtrl&bits == bits {
+		return
+	}
+	if addr < portVolCh1 && addr&1 != 0 {
+		// frequencies are checked once, at their low byte
+		return
+	}
+	if v.unused[addr] {
+		v.warn("%s, overwritten before use", problem)
+	}
+	v.unused[addr] = true
+}
+
+// endFrame checks the state at the end of a frame, once the frame's writes
+// have all taken place.
+func (v *songValidator) endFrame(noise uint8) {
+	if v.samplePlayed && !HyperVoice && v.chCtrl&chCtrlVoice == 0 {
+		v.warn("sample played while channel 2 is not in voice mode")
+	}
+	v.samplePlayed = false
+	if v.chCtrl&(chCtrlNoise|0x08) == chCtrlNoise|0x08 && noise&noiseCtrlEnable == 0 {
+		v.warn("channel 4 plays noise with the noise generator stopped")
+	}
+}
+
+// ValidateSong checks a converted song for writes which have no effect, or
+// which the engine does not expect.
+func ValidateSong(song *Song) *validationReport {
+	v := songValidator{unused: make(map[uint8]bool)}
+	noise := uint8(noiseCtrlEnable)
+	for _, frame := range song.Commands {
+		for _, cmdRaw := range frame.Commands {
+			switch cmd := cmdRaw.(type) {
+			case *CommandWritePort:
+				for i, value := range cmd.Data {
+					addr := cmd.Address + uint8(i)
+					if addr == portNoiseCtrl {
+						noise = value
+					}
+					v.writePort(addr, value)
+				}
+			case *CommandPlaySample:
+				if cmd.Sample != nil {
+					v.samplePlayed = true
+				}
+			case *CommandWait:
+				v.endFrame(noise)
+			}
+		}
+	}
+	return &v.validationReport
+}
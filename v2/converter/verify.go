@@ -0,0 +1,282 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// romVerifier checks a test ROM's footer, song table and song bytecode.
+type romVerifier struct {
+	rom         []byte
+	wideBanks   bool
+	globalWaves bool
+	problems    []error
+}
+
+func (v *romVerifier) errorf(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Errorf(format, args...))
+}
+
+// dataEnd returns the end of the area song data may be read from: the whole
+// ROM, excluding its footer.
+func (v *romVerifier) dataEnd() int {
+	return len(v.rom) - romFooterSize
+}
+
+func (v *romVerifier) bankBytes() int {
+	if v.wideBanks {
+		return 2
+	} else {
+		return 1
+	}
+}
+
+// readBankPosition reads an offset and bank delta relative to bank,
+// returning the absolute position. Bank deltas wrap around, as the engine's
+// bank register does.
+func (v *romVerifier) readBankPosition(at int, bank int) int {
+	if v.wideBanks {
+		bank = (bank + v.read16(at+2)) & 0xFFFF
+	} else {
+		bank = (bank + int(v.rom[at+2])) & 0xFF
+	}
+	return bank<<16 | v.read16(at)
+}
+
+func (v *romVerifier) read16(at int) int {
+	return int(v.rom[at]) | int(v.rom[at+1])<<8
+}
+
+func (v *romVerifier) checkFooter() {
+	footer := v.rom[len(v.rom)-romFooterSize:]
+	checksum := uint16(0)
+	for _, d := range v.rom[:len(v.rom)-2] {
+		checksum += uint16(d)
+	}
+	if stored := uint16(footer[romFooterChecksum]) | uint16(footer[romFooterChecksum+1])<<8; stored != checksum {
+		v.errorf("footer checksum is %04X, expected %04X", stored, checksum)
+	}
+	if value, ok := romSizeToHeaderValue[len(v.rom)]; !ok {
+		v.errorf("ROM length %d is not a valid ROM size", len(v.rom))
+	} else if footer[romFooterROMSize] != value {
+		v.errorf("footer ROM size is %02X, expected %02X for %d bytes", footer[romFooterROMSize], value, len(v.rom))
+	}
+}
+
+// songTable returns the absolute positions of the songs in the song pointer
+// table, which the engine scans until an entry's bank byte is 0xFF.
+func (v *romVerifier) songTable() []int {
+	entrySize := 2 + v.bankBytes()
+	songs := []int{}
+	for at := 0; ; at += entrySize {
+		if at+entrySize > 0x10000 || at+entrySize > v.dataEnd() {
+			v.errorf("song pointer table has no 0xFF terminator")
+			return songs
+		}
+		if v.rom[at+2] == 0xFF {
+			return songs
+		}
+		songs = append(songs, v.readBankPosition(at, 0))
+	}
+}
+
+// checkTarget reports a position operand which points outside of the data.
+func (v *romVerifier) checkTarget(song int, at int, opcode uint8, target int, length int) {
+	if target+length > v.dataEnd() {
+		v.errorf("song %d: %02X at %06X targets %06X, outside of the ROM", song, opcode, at, target)
+	}
+}
+
+// checkSong walks a song's bytecode from start until it ends or loops.
+func (v *romVerifier) checkSong(song int, start int) {
+	pos := start
+	v.checkTarget(song, 0, 0xFF, start, 1)
+	// operand returns the absolute position of an operand, or -1 if it
+	// would cross the end of the bank or of the data
+	operand := func(at int, length int) int {
+		if (at&0xFFFF)+length > 0x10000 || at+length > v.dataEnd() {
+			v.errorf("song %d: command at %06X runs past the end of its bank", song, pos)
+			return -1
+		}
+		return at
+	}
+	for {
+		if operand(pos, 1) < 0 {
+			return
+		}
+		bank := pos &^ 0xFFFF
+		cmd := v.rom[pos]
+		switch {
+		case cmd < 0x40:
+			at := operand(pos+1, 1)
+			if at < 0 {
+				return
+			}
+			length := int(v.rom[at])
+			if int(cmd)+length > 0x40 {
+				v.errorf("song %d: memory write at %06X runs past the wavetables", song, pos)
+			}
+			if operand(pos+2, length) < 0 {
+				return
+			}
+			pos += 2 + length
+		case cmd < 0x60:
+			if operand(pos+1, 1) < 0 {
+				return
+			}
+			pos += 2
+		case cmd < 0x80:
+			if operand(pos+1, 2) < 0 {
+				return
+			}
+			pos += 3
+		case cmd == 0xEA || cmd == 0xEC:
+			if operand(pos+1, 1) < 0 {
+				return
+			}
+			pos += 2
+		case cmd == 0xEB || cmd == 0xFA:
+			at := pos + 1
+			if cmd == 0xEB {
+				at++
+			}
+			if operand(at, 2+v.bankBytes()) < 0 {
+				return
+			}
+			v.checkTarget(song, pos, cmd, v.readBankPosition(at, bank>>16), 1)
+			if cmd == 0xFA {
+				return
+			}
+			pos = at + 2 + v.bankBytes()
+		case cmd == 0xED:
+			return
+		case cmd == 0xEE:
+			if operand(pos+1, 2) < 0 {
+				return
+			}
+			pos += 3
+		case cmd == 0xEF:
+			if operand(pos+1, 2) < 0 {
+				return
+			}
+			v.checkTarget(song, pos, cmd, bank+v.read16(pos+1), 1)
+			pos += 3
+		case cmd >= 0xF0 && cmd <= 0xF6:
+			pos++
+		case cmd == 0xF7:
+			pos = bank + 0x10000
+			v.checkTarget(song, bank+0xFFFF, cmd, pos, 1)
+		case cmd == 0xF8:
+			if operand(pos+1, 1) < 0 {
+				return
+			}
+			pos += 2
+		case cmd == 0xF9:
+			if operand(pos+1, 2) < 0 {
+				return
+			}
+			pos += 3
+		case cmd == 0xFB:
+			at := operand(pos+1, 1)
+			if at < 0 {
+				return
+			}
+			if v.rom[at]&0x80 != 0 {
+				if operand(pos+2, 4) < 0 {
+					return
+				}
+				pos += 6
+			} else {
+				pos += 2
+			}
+		case cmd >= 0xFC:
+			if operand(pos+1, 2) < 0 {
+				return
+			}
+			// global wavetables are read from the first bank
+			target := bank + v.read16(pos+1)
+			if v.globalWaves {
+				target = v.read16(pos + 1)
+			}
+			if (target&0xFFFF)+16 > 0x10000 {
+				v.errorf("song %d: %02X at %06X targets %06X, crossing the end of its bank", song, cmd, pos, target)
+			}
+			v.checkTarget(song, pos, cmd, target, 16)
+			pos += 3
+		default:
+			v.errorf("song %d: unknown opcode %02X at %06X", song, cmd, pos)
+			return
+		}
+	}
+}
+
+// VerifyROM checks a test ROM built by the converter, returning every
+// problem found.
+func VerifyROM(rom []byte, wideBanks bool, globalWaves bool) []error {
+	v := romVerifier{rom: rom, wideBanks: wideBanks, globalWaves: globalWaves}
+	if len(rom) < romFooterSize {
+		v.errorf("ROM is smaller than its footer")
+		return v.problems
+	}
+	v.checkFooter()
+	for i, start := range v.songTable() {
+		v.checkSong(i, start)
+	}
+	return v.problems
+}
+
+// runVerify implements the verify command, returning the exit status.
+func runVerify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	wideBanks := flags.Bool("mapper-2003", false, "The ROM uses 16-bit bank deltas.")
+	globalWaves := flags.Bool("global-wavetables", false, "The ROM reads cached wavetables from the first bank.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s verify [options] rom.ws...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() <= 0 {
+		flags.Usage()
+		return 1
+	}
+	status := 0
+	for _, filename := range flags.Args() {
+		rom, err := os.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		problems := VerifyROM(rom, *wideBanks, *globalWaves)
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filename, problem)
+		}
+		if len(problems) > 0 {
+			status = 1
+		} else {
+			fmt.Printf("%s: OK\n", filename)
+		}
+	}
+	return status
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testROM builds a 128KiB ROM with the given data placed at its offsets
+// and a valid footer.
+func testROM(data map[int][]byte) []byte {
+	rom := make([]byte, 128*1024)
+	for at, d := range data {
+		copy(rom[at:], d)
+	}
+	fixROMChecksum(rom)
+	return rom
+}
+
+func fixROMChecksum(rom []byte) {
+	checksum := uint16(0)
+	for _, d := range rom[:len(rom)-2] {
+		checksum += uint16(d)
+	}
+	rom[len(rom)-2] = uint8(checksum)
+	rom[len(rom)-1] = uint8(checksum >> 8)
+}
+
+func TestVerifyROM(t *testing.T) {
+	// song pointer tables with a single song, at 0x0010 or 0x10010
+	table := []byte{0x10, 0x00, 0x00, 0x00, 0x00, 0xFF}
+	tableBank1 := []byte{0x10, 0x00, 0x01, 0x00, 0x00, 0xFF}
+	wideTable := []byte{0x10, 0x00, 0x01, 0x00, 0x00, 0x00, 0xFF, 0xFF}
+
+	tests := []struct {
+		name        string
+		rom         []byte
+		wideBanks   bool
+		globalWaves bool
+		want        string
+	}{
+		{"valid", testROM(map[int][]byte{0: table, 0x10: {0xF0, 0x00, 0x01, 0x02, 0x70, 0x10, 0x00, 0xED}}), false, false, ""},
+		{"loop", testROM(map[int][]byte{0: table, 0x10: {0xF0, 0xFA, 0x10, 0x00, 0x00}}), false, false, ""},
+		{"next bank", testROM(map[int][]byte{0: table, 0x10: {0xF7}, 0x10000: {0xED}}), false, false, ""},
+		{"wide banks", testROM(map[int][]byte{0: wideTable, 0x10010: {0xEB, 0x00, 0x20, 0x00, 0xFF, 0xFF, 0xED}, 0x20: {0xED}}), true, false, ""},
+		{"too small", make([]byte, 8), false, false, "smaller than its footer"},
+		{"invalid size", append([]byte{0x00, 0x00, 0xFF}, make([]byte, 64*1024-3)...), false, false, "not a valid ROM size"},
+		{"unknown opcode", testROM(map[int][]byte{0: table, 0x10: {0x80}}), false, false, "unknown opcode 80"},
+		{"memory write past wavetables", testROM(map[int][]byte{0: table, 0x10: {0x3F, 0x02, 0x00, 0x00, 0xED}}), false, false, "runs past the wavetables"},
+		{"jump outside of the ROM", testROM(map[int][]byte{0: table, 0x10: {0xFA, 0x00, 0x00, 0x05}}), false, false, "outside of the ROM"},
+		{"jump wraps around", testROM(map[int][]byte{0: tableBank1, 0x10010: {0xFA, 0x10, 0x00, 0xFF}}), false, false, ""},
+		{"command crossing its bank", testROM(map[int][]byte{0: {0xFF, 0xFF, 0x00, 0x00, 0x00, 0xFF}, 0xFFFF: {0x70}}), false, false, "runs past the end of its bank"},
+		{"wavetable crossing its bank", testROM(map[int][]byte{0: table, 0x10: {0xFC, 0xF8, 0xFF, 0xED}}), false, false, "crossing the end of its bank"},
+		{"wavetable in the footer", testROM(map[int][]byte{0: tableBank1, 0x10010: {0xFC, 0xE8, 0xFF, 0xED}}), false, false, "outside of the ROM"},
+		// global wavetables are read from the first bank
+		{"global wavetable", testROM(map[int][]byte{0: tableBank1, 0x10010: {0xFC, 0xE8, 0xFF, 0xED}}), false, true, ""},
+	}
+	for _, tt := range tests {
+		problems := VerifyROM(tt.rom, tt.wideBanks, tt.globalWaves)
+		if len(tt.want) == 0 {
+			if len(problems) > 0 {
+				t.Errorf("%s: unexpected problems %v", tt.name, problems)
+			}
+			continue
+		}
+		found := false
+		for _, problem := range problems {
+			found = found || strings.Contains(problem.Error(), tt.want)
+		}
+		if !found {
+			t.Errorf("%s: got %v, want a problem containing %q", tt.name, problems, tt.want)
+		}
+	}
+}
+
+func TestVerifyROMFooter(t *testing.T) {
+	rom := testROM(map[int][]byte{0: {0x00, 0x00, 0xFF}})
+	if problems := VerifyROM(rom, false, false); len(problems) > 0 {
+		t.Fatalf("unexpected problems %v", problems)
+	}
+
+	rom[len(rom)-romFooterSize+romFooterROMSize] = 1
+	fixROMChecksum(rom)
+	if problems := VerifyROM(rom, false, false); len(problems) != 1 || !strings.Contains(problems[0].Error(), "footer ROM size") {
+		t.Errorf("ROM size: got %v", problems)
+	}
+
+	rom[len(rom)-romFooterSize+romFooterROMSize] = 0
+	if problems := VerifyROM(rom, false, false); len(problems) != 1 || !strings.Contains(problems[0].Error(), "checksum") {
+		t.Errorf("checksum: got %v", problems)
+	}
+}
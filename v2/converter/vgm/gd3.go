@@ -0,0 +1,92 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vgm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"unicode/utf16"
+)
+
+type GD3Tag struct {
+	TrackName          string
+	TrackNameJapanese  string
+	GameName           string
+	GameNameJapanese   string
+	SystemName         string
+	SystemNameJapanese string
+	Author             string
+	AuthorJapanese     string
+	ReleaseDate        string
+	Converter          string
+	Notes              string
+}
+
+var (
+	gd3Ident         = []byte{'G', 'd', '3', ' '}
+	ErrGD3InvalidTag = errors.New("invalid GD3 tag")
+)
+
+// ReadGD3Tag reads the GD3 tag of a VGM file, or returns nil if the file
+// does not have one.
+func ReadGD3Tag(r io.ReadSeeker, header *VGMHeader) (*GD3Tag, error) {
+	if header.OffsetGD3 == 0 {
+		return nil, nil
+	}
+	if _, err := r.Seek(int64(header.OffsetGD3), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var tagHeader struct {
+		Ident   [4]byte
+		Version uint32
+		Length  uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &tagHeader); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(tagHeader.Ident[:], gd3Ident) || tagHeader.Length%2 != 0 {
+		return nil, ErrGD3InvalidTag
+	}
+	data := make([]uint16, tagHeader.Length/2)
+	if err := binary.Read(r, binary.LittleEndian, data); err != nil {
+		return nil, err
+	}
+
+	var strings []string
+	start := 0
+	for i, c := range data {
+		if c == 0 {
+			strings = append(strings, string(utf16.Decode(data[start:i])))
+			start = i + 1
+		}
+	}
+	for len(strings) < 11 {
+		strings = append(strings, "")
+	}
+
+	return &GD3Tag{
+		strings[0], strings[1], strings[2], strings[3], strings[4], strings[5],
+		strings[6], strings[7], strings[8], strings[9], strings[10],
+	}, nil
+}
@@ -203,6 +203,9 @@ func ReadVGMHeader(r io.Reader) (*VGMHeader, error) {
 	} else if header.LoopOffset != 0 {
 		header.LoopOffset += 0x1C
 	}
+	if header.OffsetGD3 != 0 {
+		header.OffsetGD3 += 0x14
+	}
 	if version < 0x150 {
 		header.DataOffset = 0x40
 	} else {
@@ -0,0 +1,303 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// scaleVolume scales both nibbles of a channel volume value.
+func scaleVolume(v uint8, scale float64) uint8 {
+	left := math.Round(float64(v>>4) * scale)
+	right := math.Round(float64(v&0x0F) * scale)
+	return uint8(math.Min(left, 15))<<4 | uint8(math.Min(right, 15))
+}
+
+// ScaleVolume scales all channel volume writes in a song.
+func ScaleVolume(song *Song, scale float64) {
+	if scale == 1.0 {
+		return
+	}
+	for _, frame := range song.Commands {
+		for _, cmdRaw := range frame.Commands {
+			if cmd, ok := cmdRaw.(*CommandWritePort); ok {
+				for i := range cmd.Data {
+					addr := cmd.Address + uint8(i)
+					if addr >= portVolCh1 && addr < portVolCh1+4 {
+						cmd.Data[i] = scaleVolume(cmd.Data[i], scale)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Stereo modes, rewriting the left and right nibbles of channel volume
+// writes.
+const (
+	stereoKeep = iota
+	stereoMono
+	stereoSwap
+)
+
+// checkVolumeScale rejects volume scale factors which cannot be applied.
+func checkVolumeScale(scale float64) error {
+	if scale < 0 || math.IsNaN(scale) {
+		return fmt.Errorf("invalid volume %v", scale)
+	}
+	return nil
+}
+
+// parseStereoMode parses a stereo mode: stereo, mono or swap.
+func parseStereoMode(value string) (int, error) {
+	switch value {
+	case "stereo":
+		return stereoKeep, nil
+	case "mono":
+		return stereoMono, nil
+	case "swap":
+		return stereoSwap, nil
+	default:
+		return 0, fmt.Errorf("invalid stereo mode %q", value)
+	}
+}
+
+// parsePanOffsets parses per-channel pan offsets of the form "-4:0:0:4".
+// Negative offsets quiet the right side of a channel, positive offsets the
+// left side.
+func parsePanOffsets(value string) ([4]int, error) {
+	var result [4]int
+	fields := strings.Split(value, ":")
+	if len(fields) != 4 {
+		return result, fmt.Errorf("invalid pan offsets %q: expected four values", value)
+	}
+	for i, field := range fields {
+		v, err := strconv.Atoi(field)
+		if err != nil || v < -15 || v > 15 {
+			return result, fmt.Errorf("invalid pan offset %q", field)
+		}
+		result[i] = v
+	}
+	return result, nil
+}
+
+// panVolume applies a stereo mode and pan offset to a channel volume value.
+func panVolume(v uint8, mode int, pan int) uint8 {
+	left := int(v >> 4)
+	right := int(v & 0x0F)
+	switch mode {
+	case stereoMono:
+		left = (left + right + 1) / 2
+		right = left
+	case stereoSwap:
+		left, right = right, left
+	}
+	if pan > 0 {
+		left -= pan
+		if left < 0 {
+			left = 0
+		}
+	} else if pan < 0 {
+		right += pan
+		if right < 0 {
+			right = 0
+		}
+	}
+	return uint8(left<<4 | right)
+}
+
+// panVoiceVolume applies a stereo mode to a HyperVoice volume value, which
+// holds the right output in bits 0-1 and the left output in bits 2-3.
+func panVoiceVolume(v uint8, mode int) uint8 {
+	left := (v >> 2) & 0x03
+	right := v & 0x03
+	switch mode {
+	case stereoMono:
+		if right > left {
+			left = right
+		}
+		right = left
+	case stereoSwap:
+		left, right = right, left
+	}
+	return (v & 0xF0) | left<<2 | right
+}
+
+// PanVolume rewrites all channel volume writes in a song for the given
+// stereo mode and per-channel pan offsets. Channel 2 volume writes made while
+// voice mode is enabled are sample data and left alone.
+func PanVolume(song *Song, mode int, pan [4]int) {
+	if mode == stereoKeep && pan == [4]int{} {
+		return
+	}
+	voice := false
+	for _, frame := range song.Commands {
+		for _, cmdRaw := range frame.Commands {
+			cmd, ok := cmdRaw.(*CommandWritePort)
+			if !ok {
+				continue
+			}
+			for i := range cmd.Data {
+				addr := cmd.Address + uint8(i)
+				switch {
+				case addr == portChCtrl:
+					voice = (cmd.Data[i] & chCtrlVoice) != 0
+				case addr == portVolCh1+1 && voice:
+				case addr >= portVolCh1 && addr < portVolCh1+4:
+					ch := addr - portVolCh1
+					cmd.Data[i] = panVolume(cmd.Data[i], mode, pan[ch])
+				case addr == portVoiceVolume:
+					cmd.Data[i] = panVoiceVolume(cmd.Data[i], mode)
+				}
+			}
+		}
+	}
+}
+
+// waitUnitsPerSecond returns the amount of wait units in one second of
+// playback, for the selected timing mode.
+func waitUnitsPerSecond() float64 {
+	if HBlankTiming {
+		return 12000
+	} else {
+		return 12000.0 / 159.0
+	}
+}
+
+// FadeOut fades a song out over the given amount of seconds using
+// attenuation commands, after which the song is silenced and stopped. Looping
+// songs are extended with playback from their loop point; other songs fade
+// out over their own end.
+func FadeOut(song *Song, seconds float64) {
+	total := uint32(seconds * waitUnitsPerSecond())
+	elapsed := uint32(0)
+	level := uint8(0)
+	var frames []*CommandFrame
+	newFrame := &CommandFrame{}
+	// fadeWait appends a wait, split wherever the attenuation level changes
+	fadeWait := func(length uint32) {
+		for length > 0 && elapsed < total {
+			step := length
+			// rounded up, so that every level is reached
+			nextLevelElapsed := uint32((uint64(total)*uint64(level+1) + 15) / 16)
+			if nextLevelElapsed > elapsed && nextLevelElapsed-elapsed < step {
+				step = nextLevelElapsed - elapsed
+			}
+			newFrame.Commands = append(newFrame.Commands, &CommandWait{step})
+			elapsed += step
+			length -= step
+			frames = append(frames, newFrame)
+			newFrame = &CommandFrame{}
+
+			newLevel := uint8(uint64(elapsed) * 16 / uint64(total))
+			if newLevel != level && newLevel < 16 {
+				level = newLevel
+				newFrame.Commands = append(newFrame.Commands, &CommandAttenuation{level})
+			}
+		}
+	}
+
+	if song.LoopCount == 0 {
+		length := uint32(0)
+		for _, frame := range song.Commands {
+			for _, cmdRaw := range frame.Commands {
+				if wait, ok := cmdRaw.(*CommandWait); ok {
+					length += wait.Length
+				}
+			}
+		}
+		if total > length {
+			total = length
+		}
+		start := length - total
+		pos := uint32(0)
+		for _, frame := range song.Commands {
+			if len(newFrame.Commands) == 0 {
+				newFrame.LoopFrame = frame.LoopFrame
+			}
+			for _, cmdRaw := range frame.Commands {
+				wait, ok := cmdRaw.(*CommandWait)
+				if !ok {
+					newFrame.Commands = append(newFrame.Commands, cmdRaw)
+					continue
+				}
+				remaining := wait.Length
+				if pos < start {
+					step := remaining
+					if start-pos < step {
+						step = start - pos
+					}
+					newFrame.Commands = append(newFrame.Commands, &CommandWait{step})
+					pos += step
+					remaining -= step
+					frames = append(frames, newFrame)
+					newFrame = &CommandFrame{}
+				}
+				pos += remaining
+				fadeWait(remaining)
+			}
+		}
+		song.Commands = frames
+	} else {
+		loopStart := 0
+		for i, frame := range song.Commands {
+			if frame.LoopFrame {
+				loopStart = i
+			}
+		}
+		loopFrames := song.Commands[loopStart:]
+		for total > 0 && elapsed < total {
+			lastElapsed := elapsed
+			for _, frame := range loopFrames {
+				for _, cmdRaw := range frame.Commands {
+					if elapsed >= total {
+						break
+					}
+					if wait, ok := cmdRaw.(*CommandWait); ok {
+						fadeWait(wait.Length)
+					} else {
+						newFrame.Commands = append(newFrame.Commands, cmdRaw)
+					}
+				}
+			}
+			if elapsed == lastElapsed {
+				// the loop does not advance time
+				break
+			}
+		}
+		song.Commands = append(song.Commands, frames...)
+	}
+
+	// silence all channels
+	newFrame.Commands = append(newFrame.Commands,
+		&CommandWritePort{portChCtrl, []byte{0}},
+		&CommandWritePort{portVolCh1, []byte{0, 0}},
+		&CommandWritePort{portVolCh1 + 2, []byte{0, 0}},
+	)
+	if len(song.Samples) > 0 {
+		newFrame.Commands = append(newFrame.Commands, &CommandPlaySample{})
+	}
+	song.Commands = append(song.Commands, newFrame)
+	song.LoopCount = 0
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import "testing"
+
+// testSong builds a song from frames of commands, marking frame loopFrame
+// as the loop point.
+func testSong(loopFrame int, loopCount int, frames ...[]interface{}) *Song {
+	song := &Song{LoopCount: loopCount}
+	for i, commands := range frames {
+		song.Commands = append(song.Commands, &CommandFrame{
+			Commands:  commands,
+			LoopFrame: i == loopFrame,
+		})
+	}
+	return song
+}
+
+// songWaits returns the total length of a song's waits.
+func songWaits(song *Song) uint32 {
+	total := uint32(0)
+	for _, frame := range song.Commands {
+		for _, cmdRaw := range frame.Commands {
+			if cmd, ok := cmdRaw.(*CommandWait); ok {
+				total += cmd.Length
+			}
+		}
+	}
+	return total
+}
+
+func TestScaleVolume(t *testing.T) {
+	tests := []struct {
+		scale float64
+		data  []byte
+		want  []byte
+	}{
+		{1.0, []byte{0xF8, 0x42}, []byte{0xF8, 0x42}},
+		{0.5, []byte{0xF8, 0x42}, []byte{0x84, 0x21}},
+		{2.0, []byte{0xF8, 0x42}, []byte{0xFF, 0x84}},
+		{0.0, []byte{0xF8, 0x42}, []byte{0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		write := &CommandWritePort{portVolCh1, append([]byte{}, tt.data...)}
+		// channel control is not a volume port
+		ctrl := &CommandWritePort{portChCtrl, []byte{0x0F}}
+		song := testSong(-1, 0, []interface{}{write, ctrl})
+		ScaleVolume(song, tt.scale)
+		if string(write.Data) != string(tt.want) {
+			t.Errorf("scale %v: got % X, want % X", tt.scale, write.Data, tt.want)
+		}
+		if ctrl.Data[0] != 0x0F {
+			t.Errorf("scale %v: channel control changed to %02X", tt.scale, ctrl.Data[0])
+		}
+	}
+}
+
+func TestCheckVolumeScale(t *testing.T) {
+	for _, scale := range []float64{0, 0.5, 1, 4} {
+		if err := checkVolumeScale(scale); err != nil {
+			t.Errorf("scale %v: unexpected error %v", scale, err)
+		}
+	}
+	if err := checkVolumeScale(-0.5); err == nil {
+		t.Errorf("scale -0.5: expected an error")
+	}
+}
+
+func TestFadeOut(t *testing.T) {
+	defer func(v bool) { HBlankTiming = v }(HBlankTiming)
+	HBlankTiming = true
+
+	port := &CommandWritePort{portVolCh1, []byte{0xFF}}
+	tests := []struct {
+		name      string
+		song      *Song
+		seconds   float64
+		wantWaits uint32
+		fadeStart uint32
+	}{
+		// 0.1 seconds are 1200 wait units
+		{
+			"without a loop, the end of the song fades",
+			testSong(0, 0, []interface{}{port, &CommandWait{2000}}, []interface{}{&CommandWait{1000}}),
+			0.1, 3000, 1800,
+		},
+		{
+			"without a loop, a fade longer than the song covers all of it",
+			testSong(0, 0, []interface{}{port, &CommandWait{600}}),
+			0.1, 600, 0,
+		},
+		{
+			"a looping song is extended from its loop point",
+			testSong(1, LoopForever, []interface{}{port, &CommandWait{2000}}, []interface{}{port, &CommandWait{500}}),
+			0.1, 2500 + 1200, 2500,
+		},
+		{
+			"a finite loop is replaced as well",
+			testSong(1, 3, []interface{}{&CommandWait{100}}, []interface{}{port, &CommandWait{5000}}),
+			0.1, 5100 + 1200, 5100,
+		},
+	}
+	for _, tt := range tests {
+		FadeOut(tt.song, tt.seconds)
+		if got := songWaits(tt.song); got != tt.wantWaits {
+			t.Errorf("%s: waits add up to %d, want %d", tt.name, got, tt.wantWaits)
+		}
+		if tt.song.LoopCount != 0 {
+			t.Errorf("%s: loop count %d left", tt.name, tt.song.LoopCount)
+		}
+		// attenuation must rise step by step, starting where the fade does
+		elapsed := uint32(0)
+		level := uint8(0)
+		for _, frame := range tt.song.Commands {
+			for _, cmdRaw := range frame.Commands {
+				switch cmd := cmdRaw.(type) {
+				case *CommandWait:
+					elapsed += cmd.Length
+				case *CommandAttenuation:
+					if level == 0 && elapsed < tt.fadeStart {
+						t.Errorf("%s: fade starts at %d, want %d", tt.name, elapsed, tt.fadeStart)
+					}
+					if cmd.Level != level+1 {
+						t.Errorf("%s: attenuation %d follows %d", tt.name, cmd.Level, level)
+					}
+					level = cmd.Level
+				}
+			}
+		}
+		if level != 15 {
+			t.Errorf("%s: fade ends at attenuation %d", tt.name, level)
+		}
+		// the song ends silenced
+		last := tt.song.Commands[len(tt.song.Commands)-1].Commands
+		if ctrl, ok := last[0].(*CommandWritePort); !ok || ctrl.Address != portChCtrl || ctrl.Data[0] != 0 {
+			t.Errorf("%s: song does not end by silencing all channels", tt.name)
+		}
+	}
+}
+
+func TestFadeOutLoopWithoutWaits(t *testing.T) {
+	// a loop which does not advance time must not be extended forever
+	song := testSong(1, LoopForever, []interface{}{&CommandWait{100}}, []interface{}{&CommandWritePort{portVolCh1, []byte{0xFF}}})
+	FadeOut(song, 1)
+	if got := songWaits(song); got != 100 {
+		t.Errorf("waits add up to %d, want 100", got)
+	}
+}
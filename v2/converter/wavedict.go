@@ -0,0 +1,80 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import "io"
+
+// cacheableWave returns the waveform written by a command, if the command
+// can be replaced by a 0xFC-0xFF command.
+func cacheableWave(cmdRaw interface{}) ([16]byte, bool) {
+	cmd, ok := cmdRaw.(*CommandWriteMemory)
+	if !ok || !Emit0xFC || (cmd.Address&0x000F) != 0 || cmd.Address >= 0x40 || len(cmd.Data) != 16 {
+		return [16]byte{}, false
+	}
+	return *(*[16]byte)(cmd.Data), true
+}
+
+// waveCommand returns a 0xFC-0xFF command loading the waveform at pos into
+// the wavetable at address.
+func waveCommand(address uint16, pos uint16) []byte {
+	return []byte{uint8(0xFC + (address >> 4)), uint8(pos), uint8(pos >> 8)}
+}
+
+// sharedWaves returns the waveforms written at least twice by the given
+// songs, in order of first use. Storing these once is never larger than
+// writing them inline.
+func sharedWaves(songs []*Song) [][16]byte {
+	counts := make(map[[16]byte]int)
+	result := [][16]byte{}
+	for _, song := range songs {
+		for _, frame := range song.Commands {
+			for _, cmdRaw := range frame.Commands {
+				if key, ok := cacheableWave(cmdRaw); ok {
+					counts[key]++
+					if counts[key] == 2 {
+						result = append(result, key)
+					}
+				}
+			}
+		}
+	}
+	return result
+}
+
+// waveDictionary maps waveforms stored together in the first bank to their
+// positions.
+type waveDictionary struct {
+	positions map[[16]byte]uint16
+}
+
+// writeWaveDictionary writes the given waveforms at position, returning
+// their dictionary.
+func writeWaveDictionary(w io.Writer, position uint32, waves [][16]byte) (*waveDictionary, error) {
+	d := &waveDictionary{positions: make(map[[16]byte]uint16)}
+	for _, wave := range waves {
+		if _, err := w.Write(wave[:]); err != nil {
+			return nil, err
+		}
+		d.positions[wave] = uint16(position)
+		position += 16
+	}
+	return d, nil
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// waveWindow holds the wavetable contents last emitted, where known.
+type waveWindow struct {
+	emitted [64]uint8
+	known   [64]bool
+}
+
+// waveRAM tracks a VGM's memory writes, emitting changes to the wavetables
+// once per frame.
+//
+// Without a target wave base, the song's wavetables are written wherever
+// the engine's wave base points, and moving them becomes a rewrite of their
+// contents. With one, the song's first wavetable address is mapped to the
+// target, and wave base writes are kept, moved by the same amount.
+type waveRAM struct {
+	mem [0x10000]uint8
+	set [0x10000]bool
+	// address of the wavetables, as selected by the wave base port
+	base uint16
+	// the song's first wavetable address, mapped to WaveBase
+	origin    uint16
+	originSet bool
+	// whether the engine's wave base matches base
+	baseKnown bool
+	// emitted contents for each wavetable address, or only one without a
+	// target wave base
+	windows map[uint16]*waveWindow
+	// waveforms emitted as full 16-byte writes, which the bank writer can
+	// replace with 0xFC-0xFF commands, and waveforms seen at all
+	fullWaves map[[16]uint8]bool
+	seenWaves map[[16]uint8]bool
+	// writes to addresses outside of the wavetables, which are dropped
+	// unless the wave base moves to them
+	outside map[uint16]int
+	// index in the frame of the first write since the last emit
+	insertAt int
+	pending  bool
+}
+
+func newWaveRAM() *waveRAM {
+	return &waveRAM{
+		windows:   make(map[uint16]*waveWindow),
+		fullWaves: make(map[[16]uint8]bool),
+		seenWaves: make(map[[16]uint8]bool),
+		outside:   make(map[uint16]int),
+	}
+}
+
+// window returns the emitted contents of the current wavetables.
+func (w *waveRAM) window() *waveWindow {
+	key := uint16(0)
+	if WaveBase >= 0 {
+		key = w.base
+	}
+	if _, ok := w.windows[key]; !ok {
+		w.windows[key] = &waveWindow{}
+	}
+	return w.windows[key]
+}
+
+func (w *waveRAM) useOrigin() {
+	if !w.originSet {
+		w.origin = w.base
+		w.originSet = true
+	}
+}
+
+func (w *waveRAM) write(frame *CommandFrame, addr uint16, value uint8) {
+	w.useOrigin()
+	if !w.pending {
+		w.insertAt = len(frame.Commands)
+		w.pending = true
+	}
+	w.mem[addr] = value
+	w.set[addr] = true
+	if addr < w.base || addr >= w.base+64 {
+		w.outside[addr]++
+	}
+}
+
+// dropped returns the amount of writes to addresses the wavetables were
+// never moved to.
+func (w *waveRAM) dropped() int {
+	result := 0
+	for _, count := range w.outside {
+		result += count
+	}
+	return result
+}
+
+func (w *waveRAM) moveBase(base uint16) {
+	w.base = base
+	for i := uint16(0); i < 64; i++ {
+		delete(w.outside, base+i)
+	}
+}
+
+// setBase handles a write to the wave base port.
+func (w *waveRAM) setBase(frame *CommandFrame, value uint8) error {
+	base := uint16(value) << 6
+	if !w.originSet {
+		w.origin = base
+		w.originSet = true
+	}
+	if WaveBase < 0 || (base == w.base && w.baseKnown) {
+		w.moveBase(base)
+		return nil
+	}
+	if _, err := w.targetBase(base); err != nil {
+		return err
+	}
+	if w.pending {
+		// earlier writes go to the old wavetables
+		w.emit(frame)
+	}
+	w.moveBase(base)
+	w.baseKnown = false
+	w.insertAt = len(frame.Commands)
+	w.pending = true
+	return nil
+}
+
+// targetBase returns the wave base port value the song's wavetables at base
+// are moved to.
+func (w *waveRAM) targetBase(base uint16) (uint8, error) {
+	target := WaveBase + int(base) - int(w.origin)
+	if target < 0 || target > 0xFF<<6 {
+		return 0, fmt.Errorf("wavetables at %04X would move to %X, outside of the wave base range", base, target)
+	}
+	return uint8(target >> 6), nil
+}
+
+// invalidate forces all written wavetable bytes, and the wave base, to be
+// emitted again.
+func (w *waveRAM) invalidate() {
+	w.windows = make(map[uint16]*waveWindow)
+	w.baseKnown = false
+}
+
+// emit adds commands for the wavetable bytes which changed since the last
+// emit to a frame, in place of the writes which changed them.
+func (w *waveRAM) emit(frame *CommandFrame) {
+	if !w.pending {
+		w.insertAt = 0
+	}
+	cmds := []interface{}{}
+	if WaveBase >= 0 && w.originSet && !w.baseKnown {
+		// checked when the song set the base
+		value, _ := w.targetBase(w.base)
+		cmds = append(cmds, &CommandWritePort{portWaveBase, []byte{value}})
+		w.baseKnown = true
+	}
+	for block := uint16(0); block < 64; block += 16 {
+		cmds = append(cmds, w.emitBlock(block)...)
+	}
+	if len(cmds) > 0 {
+		rest := append(cmds, frame.Commands[w.insertAt:]...)
+		frame.Commands = append(frame.Commands[:w.insertAt], rest...)
+	}
+	w.pending = false
+}
+
+// allSet returns true if the wavetable bytes at offset were all written.
+func (w *waveRAM) allSet(offset uint16, length int) bool {
+	for i := 0; i < length; i++ {
+		if !w.set[w.base+offset+uint16(i)] {
+			return false
+		}
+	}
+	return true
+}
+
+// emitBlock returns the cheapest commands updating one channel's wavetable:
+// runs of changed bytes, merged across gaps where that saves bytes, or a
+// single full write. Waveforms seen before, or replacing most of the old
+// one, are written in full, so that their later uses can become 0xFC-0xFF
+// commands.
+func (w *waveRAM) emitBlock(block uint16) []interface{} {
+	win := w.window()
+	var full [16]uint8
+	complete := true
+	runs := []*CommandWriteMemory{}
+	runsCost := 0
+	lastChanged := -16
+	for i := uint16(0); i < 16; i++ {
+		addr := w.base + block + i
+		full[i] = w.mem[addr]
+		if !w.set[addr] {
+			complete = false
+			continue
+		}
+		if win.known[block+i] && win.emitted[block+i] == w.mem[addr] {
+			continue
+		}
+		if gap := int(i) - lastChanged - 1; len(runs) > 0 && gap <= 2 && w.allSet(block+uint16(lastChanged+1), gap) {
+			// a gap of two bytes costs as much as a new command
+			run := runs[len(runs)-1]
+			for j := lastChanged + 1; j <= int(i); j++ {
+				run.Data = append(run.Data, w.mem[w.base+block+uint16(j)])
+			}
+			runsCost += gap + 1
+		} else {
+			runs = append(runs, &CommandWriteMemory{block + i, []byte{w.mem[addr]}})
+			runsCost += 3
+		}
+		lastChanged = int(i)
+	}
+	if len(runs) == 0 {
+		return nil
+	}
+	useFull := false
+	if complete {
+		if w.fullWaves[full] {
+			useFull = runsCost >= 3
+		} else {
+			useFull = w.seenWaves[full] || runsCost >= 12
+		}
+		w.seenWaves[full] = true
+	}
+	for i := uint16(0); i < 16; i++ {
+		if w.set[w.base+block+i] {
+			win.emitted[block+i] = w.mem[w.base+block+i]
+			win.known[block+i] = true
+		}
+	}
+	if useFull {
+		w.fullWaves[full] = true
+		data := full
+		return []interface{}{&CommandWriteMemory{block, data[:]}}
+	}
+	cmds := make([]interface{}, len(runs))
+	for i, run := range runs {
+		cmds[i] = run
+	}
+	return cmds
+}
+
+// parseWaveBase parses a wavetable address, which must be a multiple of 64
+// reachable by the wave base port.
+func parseWaveBase(value string) (int, error) {
+	base, err := strconv.ParseUint(value, 0, 16)
+	if err != nil || base&0x3F != 0 || base > 0xFF<<6 {
+		return 0, fmt.Errorf("invalid wave base %q: expected a multiple of 0x40 up to 0x3FC0", value)
+	}
+	return int(base), nil
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2022 Adrian Siekierka
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// formatWaveCommands formats memory and port writes as "M<addr>:<data>"
+// and "P<port>:<data>".
+func formatWaveCommands(commands []interface{}) string {
+	result := []string{}
+	for _, cmdRaw := range commands {
+		switch cmd := cmdRaw.(type) {
+		case *CommandWriteMemory:
+			result = append(result, fmt.Sprintf("M%02X:% X", cmd.Address, cmd.Data))
+		case *CommandWritePort:
+			result = append(result, fmt.Sprintf("P%02X:% X", cmd.Address, cmd.Data))
+		default:
+			result = append(result, fmt.Sprintf("%+v", cmd))
+		}
+	}
+	return fmt.Sprintf("%q", result)
+}
+
+// waveWrites holds memory writes to emit together, as address, value pairs.
+type waveWrites []uint16
+
+func (writes waveWrites) emit(w *waveRAM) []interface{} {
+	frame := &CommandFrame{}
+	for i := 0; i+1 < len(writes); i += 2 {
+		w.write(frame, writes[i], uint8(writes[i+1]))
+	}
+	w.emit(frame)
+	return frame.Commands
+}
+
+// waveBytes returns writes of 16 bytes at addr, with values start, start+1...
+func waveBytes(addr uint16, start uint16) waveWrites {
+	writes := waveWrites{}
+	for i := uint16(0); i < 16; i++ {
+		writes = append(writes, addr+i, (start+i)&0xFF)
+	}
+	return writes
+}
+
+func TestWaveRAMEmit(t *testing.T) {
+	defer func(v int) { WaveBase = v }(WaveBase)
+	WaveBase = -1
+
+	tests := []struct {
+		name   string
+		before []waveWrites
+		writes waveWrites
+		want   []string
+	}{
+		{
+			"single byte",
+			nil,
+			waveWrites{0x03, 0xAB},
+			[]string{"M03:AB"},
+		},
+		{
+			"bytes in two channels",
+			nil,
+			waveWrites{0x03, 0xAB, 0x23, 0xCD},
+			[]string{"M03:AB", "M23:CD"},
+		},
+		{
+			"unwritten gap",
+			nil,
+			waveWrites{0x01, 0x11, 0x03, 0x33},
+			[]string{"M01:11", "M03:33"},
+		},
+		{
+			// merging a gap of up to two bytes costs no more than a command
+			"merged gap",
+			[]waveWrites{waveBytes(0x00, 0x00)},
+			waveWrites{0x01, 0x11, 0x04, 0x44},
+			[]string{"M01:11 02 03 44"},
+		},
+		{
+			"wide gap",
+			[]waveWrites{waveBytes(0x00, 0x00)},
+			waveWrites{0x01, 0x11, 0x05, 0x55},
+			[]string{"M01:11", "M05:55"},
+		},
+		{
+			"unchanged bytes",
+			[]waveWrites{waveBytes(0x00, 0x00)},
+			waveWrites{0x01, 0x01, 0x02, 0x02},
+			[]string{},
+		},
+		{
+			"new waveform",
+			nil,
+			waveBytes(0x10, 0x20),
+			[]string{"M10:20 21 22 23 24 25 26 27 28 29 2A 2B 2C 2D 2E 2F"},
+		},
+		{
+			// small changes to a new waveform are cheaper as runs
+			"small change",
+			[]waveWrites{waveBytes(0x00, 0x00)},
+			waveWrites{0x00, 0x10, 0x0F, 0x1F},
+			[]string{"M00:10", "M0F:1F"},
+		},
+		{
+			// waveforms seen before are written in full for the 0xFC-0xFF
+			// commands, however few bytes change
+			"waveform seen before",
+			[]waveWrites{waveBytes(0x00, 0x00), {0x0F, 0xFF}, {0x0F, 0x0F}},
+			waveWrites{0x0F, 0xFF},
+			[]string{"M00:00 01 02 03 04 05 06 07 08 09 0A 0B 0C 0D 0E FF"},
+		},
+		{
+			"waveform written in full before",
+			[]waveWrites{waveBytes(0x00, 0x00), {0x0F, 0xFF}},
+			waveWrites{0x0F, 0x0F},
+			[]string{"M00:00 01 02 03 04 05 06 07 08 09 0A 0B 0C 0D 0E 0F"},
+		},
+	}
+	for _, tt := range tests {
+		w := newWaveRAM()
+		for _, writes := range tt.before {
+			writes.emit(w)
+		}
+		if got, want := formatWaveCommands(tt.writes.emit(w)), fmt.Sprintf("%q", tt.want); got != want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, want)
+		}
+	}
+}
+
+func TestWaveRAMEmitPosition(t *testing.T) {
+	defer func(v int) { WaveBase = v }(WaveBase)
+	WaveBase = -1
+
+	// wavetable writes replace the first memory write of the frame
+	w := newWaveRAM()
+	frame := &CommandFrame{}
+	frame.Commands = append(frame.Commands, &CommandWritePort{portVolCh1, []byte{0xFF}})
+	w.write(frame, 0x00, 0x12)
+	frame.Commands = append(frame.Commands, &CommandWritePort{portChCtrl, []byte{0x0F}})
+	w.write(frame, 0x01, 0x34)
+	w.emit(frame)
+	if got, want := formatWaveCommands(frame.Commands), `["P08:FF" "M00:12 34" "P10:0F"]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestWaveRAMWaveBase(t *testing.T) {
+	defer func(v int) { WaveBase = v }(WaveBase)
+	WaveBase = 0x100
+
+	w := newWaveRAM()
+	frame := &CommandFrame{}
+	if err := w.setBase(frame, 0x01); err != nil {
+		t.Fatal(err)
+	}
+	w.write(frame, 0x40, 0x12)
+	w.emit(frame)
+	if err := w.setBase(frame, 0x02); err != nil {
+		t.Fatal(err)
+	}
+	w.write(frame, 0x80, 0x34)
+	w.emit(frame)
+	// the song's first wavetables are moved to the target wave base
+	if got, want := formatWaveCommands(frame.Commands), `["P0F:04" "M00:12" "P0F:05" "M00:34"]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if err := w.setBase(frame, 0xFF); err == nil {
+		t.Error("moving past the wave base range: expected an error")
+	}
+}
+
+func TestWaveRAMDropped(t *testing.T) {
+	defer func(v int) { WaveBase = v }(WaveBase)
+	WaveBase = -1
+
+	w := newWaveRAM()
+	frame := &CommandFrame{}
+	w.write(frame, 0x3F, 0x01)
+	w.write(frame, 0x40, 0x01)
+	w.write(frame, 0x100, 0x01)
+	w.write(frame, 0x100, 0x02)
+	if got := w.dropped(); got != 3 {
+		t.Errorf("outside writes: got %d, want 3", got)
+	}
+	// writes to the wavetables the base moves to are not dropped
+	if err := w.setBase(frame, 0x04); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.dropped(); got != 1 {
+		t.Errorf("after moving the wave base: got %d, want 1", got)
+	}
+}
+
+func TestParseWaveBase(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"0x40", 0x40, false},
+		{"0x3FC0", 0x3FC0, false},
+		{"256", 0x100, false},
+		{"0x41", 0, true},
+		{"0x4000", 0, true},
+		{"base", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseWaveBase(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v, want error %v", tt.value, err, tt.wantErr)
+		} else if got != tt.want {
+			t.Errorf("%q: got %X, want %X", tt.value, got, tt.want)
+		}
+	}
+}
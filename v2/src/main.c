@@ -49,6 +49,25 @@ static void vgm_sample_wait(uint16_t samples) {
 static vgmswan_state_t vgm_state;
 static volatile uint32_t samples_played;
 
+#ifdef VGMSWAN_TEST_VBLANK
+// lines per frame, for the playback timer
+#define VGM_FRAME_LINES 159
+
+static uint16_t vgm_frames_left;
+
+// called once per VBLANK; waits are measured in frames
+static void vgm_frame_update(void) {
+    while (vgm_frames_left == 0) {
+        uint16_t result = vgmswan_play(&vgm_state);
+        if (result == VGMSWAN_PLAYBACK_FINISHED) {
+            return;
+        }
+        vgm_frames_left = result;
+    }
+    vgm_frames_left--;
+    samples_played += VGM_FRAME_LINES;
+}
+#else
 void  __attribute__((interrupt)) vgm_interrupt_handler(void) {
     while (true) {
         uint16_t result = vgmswan_play(&vgm_state);
@@ -64,6 +83,7 @@ void  __attribute__((interrupt)) vgm_interrupt_handler(void) {
         }
     }
 }
+#endif
 
 uint8_t vbl_ticks = 0;
 uint8_t sound_levels[32] = {0};
@@ -94,7 +114,8 @@ static inline uint8_t MAX_VOL(uint8_t v) {
 }
 
 uint16_t keys_held_last = 0;
-uint8_t vgm_bank, vgm_song_id, vgm_song_count;
+vgmswan_bank_t vgm_bank;
+uint8_t vgm_song_id, vgm_song_count;
 
 void reset_song(void) {
     cpu_irq_disable();
@@ -112,10 +133,16 @@ void reset_song(void) {
         );
     }
 
+#ifdef VGMSWAN_TEST_VBLANK
+    vgm_frames_left = 0;
+
+    ws_hwint_set(HWINT_VBLANK);
+#else
     outportw(IO_HBLANK_TIMER, 3);
     outportw(IO_TIMER_CTRL, 0x01);
 
     ws_hwint_set(HWINT_HBLANK_TIMER | HWINT_VBLANK);
+#endif
     cpu_irq_enable();
 }
 
@@ -137,6 +164,9 @@ void  __attribute__((interrupt)) vbl_interrupt_handler(void) {
     keys_held_last = keys_held;
     
     ws_hwint_ack(HWINT_VBLANK);
+#ifdef VGMSWAN_TEST_VBLANK
+    vgm_frame_update();
+#endif
 
     if (keys_pressed & KEY_X4) {
         if (vgm_song_id > 0) {
@@ -205,7 +235,9 @@ int main(void) {
     }
     ws_screen_put(SCREEN1, (1 << 9) | ':', 25, 18);
 
+#ifndef VGMSWAN_TEST_VBLANK
     ws_hwint_set_handler(HWINT_IDX_HBLANK_TIMER, vgm_interrupt_handler);
+#endif
     ws_hwint_set_handler(HWINT_IDX_VBLANK, vbl_interrupt_handler);
 
     // figure out initial bank
@@ -217,7 +249,7 @@ int main(void) {
     uint8_t __far* ptr = MK_FP(0x2000, 2);
     while (*ptr != 0xFF) {
         vgm_song_count++;
-        ptr += 3;
+        ptr += 2 + VGMSWAN_BANK_BYTES;
     }
     
     vgm_song_id = 0;
@@ -31,19 +31,199 @@
 #include "wonderful-asm-common.h"
 #include "ws/hardware.h"
 
-void vgmswan_init(vgmswan_state_t *state, uint8_t bank, uint8_t song_id) {
-    outportb(IO_BANK_ROM1, bank);
-    uint8_t __far* ptr = MK_FP(0x3000, ((uint16_t) song_id) * 3);
+// shadow copies of the song's sound registers (0x80 - 0x9F) and wave RAM,
+// used to restore channels after a sound effect
+static uint8_t song_ports[0x20];
+static uint8_t song_wave[0x40];
+// channels currently owned by a sound effect
+static uint8_t song_mask = 0;
+
+// volume attenuation set by the game and by the song
+static uint8_t master_attenuation = 0;
+static uint8_t song_attenuation = 0;
+
+static vgmswan_marker_handler_t marker_handler = NULL;
+
+static vgmswan_state_t sfx_state;
+static uint8_t sfx_priority;
+static bool sfx_active = false;
+
+#ifdef VGMSWAN_MAPPER_2003
+#ifndef IO_BANK_2003_ROM0
+#define IO_BANK_2003_ROM0 0xD2
+#define IO_BANK_2003_ROM1 0xD4
+#endif
+#define get_rom0_bank() inportw(IO_BANK_2003_ROM0)
+#define set_rom0_bank(v) outportw(IO_BANK_2003_ROM0, (v))
+#define get_rom1_bank() inportw(IO_BANK_2003_ROM1)
+#define set_rom1_bank(v) outportw(IO_BANK_2003_ROM1, (v))
+#define read_bank(ptr) ((ptr)[0] | ((ptr)[1] << 8))
+#else
+#define get_rom0_bank() inportb(IO_BANK_ROM0)
+#define set_rom0_bank(v) outportb(IO_BANK_ROM0, (v))
+#define get_rom1_bank() inportb(IO_BANK_ROM1)
+#define set_rom1_bank(v) outportb(IO_BANK_ROM1, (v))
+#define read_bank(ptr) ((ptr)[0])
+#endif
+
+static uint8_t ch_ctrl_bits(uint8_t channels) {
+    uint8_t result = channels & 0x0F;
+    if (channels & 0x02) result |= 0x20; // voice
+    if (channels & 0x04) result |= 0x40; // sweep
+    if (channels & 0x08) result |= 0x80; // noise
+    return result;
+}
+
+static uint8_t port_channels(uint8_t port) {
+    port &= 0x1F;
+    if (port < 0x08) return 1 << (port >> 1); // frequency
+    if (port < 0x0C) return 1 << (port - 0x08); // volume
+    if (port < 0x0E) return 0x04; // sweep
+    if (port == 0x0E) return 0x08; // noise
+    if (port == 0x14) return 0x02; // voice volume
+    return 0;
+}
+
+static uint8_t attenuate(uint8_t port, uint8_t value, uint8_t attenuation) {
+    if (attenuation == 0 || (port & 0x1F) < 0x08 || (port & 0x1F) >= 0x0C) return value;
+    uint8_t left = value >> 4;
+    uint8_t right = value & 0x0F;
+    left = left > attenuation ? left - attenuation : 0;
+    right = right > attenuation ? right - attenuation : 0;
+    return (left << 4) | right;
+}
+
+static uint8_t song_total_attenuation(void) {
+    uint8_t result = master_attenuation + song_attenuation;
+    return result > 15 ? 15 : result;
+}
+
+static void song_port_write(uint8_t port, uint8_t value) {
+    song_ports[port & 0x1F] = value;
+    value = attenuate(port, value, song_total_attenuation());
+    if (song_mask) {
+        if (port == IO_SND_CH_CTRL) {
+            uint8_t keep = ch_ctrl_bits(song_mask);
+            value = (value & ~keep) | (inportb(IO_SND_CH_CTRL) & keep);
+        } else if (port_channels(port) & song_mask) {
+            return;
+        }
+    }
+    outportb(port, value);
+}
+
+static void sfx_port_write(uint8_t port, uint8_t value) {
+    value = attenuate(port, value, master_attenuation);
+    if (port == IO_SND_CH_CTRL) {
+        uint8_t keep = ch_ctrl_bits(song_mask);
+        value = (value & keep) | (inportb(IO_SND_CH_CTRL) & ~keep);
+    }
+    outportb(port, value);
+}
+
+static void song_wave_write(uint16_t addrPrefix, uint8_t offset, const uint8_t __far* data, uint8_t len) {
+    memcpy(song_wave + offset, data, len);
+    for (uint8_t i = 0; i < len; i++, offset++) {
+        if (!(song_mask & (1 << (offset >> 4)))) {
+            *((uint8_t*) (addrPrefix | offset)) = data[i];
+        }
+    }
+}
+
+// return the new wavetable address after a stream moves the wave base; for
+// songs, reload the wavetables of unmasked channels from there
+static uint16_t wave_base_moved(bool is_sfx) {
+    uint16_t addrPrefix = (inportb(IO_SND_WAVE_BASE) << 6);
+    if (!is_sfx) {
+        for (uint8_t ch = 0; ch < 4; ch++) {
+            if (!(song_mask & (1 << ch))) {
+                memcpy(song_wave + (ch << 4), (uint8_t*) (addrPrefix | (ch << 4)), 16);
+            }
+        }
+    }
+    return addrPrefix;
+}
+
+static void song_refresh_volume(void) {
+    uint8_t attenuation = song_total_attenuation();
+    for (uint8_t ch = 0; ch < 4; ch++) {
+        if (!(song_mask & (1 << ch))) {
+            outportb(IO_SND_VOL_CH1 + ch, attenuate(IO_SND_VOL_CH1 + ch, song_ports[0x08 + ch], attenuation));
+        }
+    }
+}
+
+static void song_restore(uint8_t channels) {
+    uint16_t addrPrefix = (inportb(IO_SND_WAVE_BASE) << 6);
+    uint8_t attenuation = song_total_attenuation();
+    for (uint8_t ch = 0; ch < 4; ch++) {
+        if (channels & (1 << ch)) {
+            outportw(IO_SND_FREQ_CH1 + (ch << 1), song_ports[ch << 1] | (song_ports[(ch << 1) + 1] << 8));
+            outportb(IO_SND_VOL_CH1 + ch, attenuate(IO_SND_VOL_CH1 + ch, song_ports[0x08 + ch], attenuation));
+            memcpy((uint8_t*) (addrPrefix | (ch << 4)), song_wave + (ch << 4), 16);
+        }
+    }
+    if (channels & 0x02) {
+        outportb(0x94, song_ports[0x14]);
+    }
+    if (channels & 0x04) {
+        outportb(0x8C, song_ports[0x0C]);
+        outportb(0x8D, song_ports[0x0D]);
+    }
+    if (channels & 0x08) {
+        outportb(0x8E, song_ports[0x0E]);
+    }
+    uint8_t keep = ch_ctrl_bits(channels);
+    outportb(IO_SND_CH_CTRL, (inportb(IO_SND_CH_CTRL) & ~keep) | (song_ports[0x10] & keep));
+}
+
+void vgmswan_init(vgmswan_state_t *state, vgmswan_bank_t bank, uint8_t song_id) {
+    set_rom1_bank(bank);
+    uint8_t __far* ptr = MK_FP(0x3000, ((uint16_t) song_id) * (2 + VGMSWAN_BANK_BYTES));
     state->pos = ptr[0] | (ptr[1] << 8);
-    state->bank = bank + ptr[2];
+    state->bank = bank + read_bank(ptr + 2);
     state->flags = 0;
+    state->loop_count = 0;
+    state->marker = 0;
+    song_attenuation = 0;
+}
+
+void vgmswan_set_marker_handler(vgmswan_marker_handler_t handler) {
+    marker_handler = handler;
+}
+
+void vgmswan_set_master_attenuation(uint8_t attenuation) {
+    master_attenuation = attenuation > 15 ? 15 : attenuation;
+    song_refresh_volume();
+}
+
+void vgmswan_sample_play(vgmswan_bank_t bank, uint16_t table_pos, uint8_t sample_id) {
+    set_rom1_bank(bank);
+    // HyperVoice tables, targeted by every entry, add the control port values
+    bool hyper_voice = *((uint8_t __far*) MK_FP(0x3000, table_pos)) & 0x10;
+    uint8_t __far* ptr = MK_FP(0x3000, table_pos + ((uint16_t) sample_id) * (hyper_voice ? 7 : 5));
+    outportb(IO_SDMA_CTRL, 0);
+    if (hyper_voice) {
+        outportb(0x6A, ptr[5]);
+        outportb(0x6B, ptr[6]);
+    }
+    outportw(IO_SDMA_SOURCE_L, *((uint16_t __far*) (ptr + 1)));
+    outportb(IO_SDMA_SOURCE_H, 0x3);
+    outportw(IO_SDMA_COUNTER_L, *((uint16_t __far*) (ptr + 3)));
+    outportb(IO_SDMA_COUNTER_H, 0);
+    outportb(IO_SDMA_CTRL, ptr[0]);
+}
+
+void vgmswan_sample_stop(void) {
+    outportb(IO_SDMA_CTRL, 0);
 }
 
 uint16_t vgmswan_play(vgmswan_state_t *state) {
-    uint8_t bank_backup = inportb(IO_BANK_ROM0);
-    outportb(IO_BANK_ROM0, state->bank);
+    vgmswan_bank_t bank_backup = get_rom0_bank();
+    set_rom0_bank(state->bank);
     uint8_t __far* ptr = MK_FP(0x2000, state->pos);
     uint16_t addrPrefix = (inportb(IO_SND_WAVE_BASE) << 6);;
+    bool is_sfx = state->flags & VGMSWAN_FLAG_SFX;
     uint16_t result = 0;
     bool restorePtr = true;
 
@@ -55,19 +235,75 @@ uint16_t vgmswan_play(vgmswan_state_t *state) {
         case 0x20: { // memory write
             uint16_t addr = cmd | addrPrefix;
             uint8_t len = *(ptr++);
-            memcpy((uint8_t*) addr, ptr, len);
+            if (is_sfx) {
+                memcpy((uint8_t*) addr, ptr, len);
+            } else {
+                song_wave_write(addrPrefix, cmd, ptr, len);
+            }
             ptr += len;
         } break;
         case 0x40: { // port write (byte)
             uint8_t v = *(ptr++);
-            outportb(cmd ^ 0xC0, v);
+            if (is_sfx) {
+                sfx_port_write(cmd ^ 0xC0, v);
+            } else {
+                song_port_write(cmd ^ 0xC0, v);
+            }
+            if ((cmd ^ 0xC0) == IO_SND_WAVE_BASE) {
+                addrPrefix = wave_base_moved(is_sfx);
+            }
         } break;
         case 0x60: { // port write (word)
             uint16_t v = *((uint16_t __far*) ptr); ptr += 2;
-            outportw(cmd ^ 0xE0, v);
+            uint8_t port = cmd ^ 0xE0;
+            if (is_sfx) {
+                sfx_port_write(port, v);
+                sfx_port_write(port + 1, v >> 8);
+            } else if (song_mask || master_attenuation || song_attenuation) {
+                song_port_write(port, v);
+                song_port_write(port + 1, v >> 8);
+            } else {
+                song_ports[port & 0x1F] = v;
+                song_ports[(port + 1) & 0x1F] = v >> 8;
+                outportw(port, v);
+            }
+            if (port == IO_SND_WAVE_BASE || port + 1 == IO_SND_WAVE_BASE) {
+                addrPrefix = wave_base_moved(is_sfx);
+            }
         } break;
         case 0xE0: { // special
             switch (cmd) {
+            case 0xEE: { // HyperVoice setup
+                outportb(0x6A, *(ptr++));
+                outportb(0x6B, *(ptr++));
+            } break;
+            case 0xEA: { // marker
+                state->marker = *(ptr++);
+                state->flags |= VGMSWAN_FLAG_MARKER;
+                if (marker_handler != NULL) marker_handler(state, state->marker);
+            } break;
+            case 0xEB: { // loop a limited number of times
+                if (state->loop_count < *(ptr++)) {
+                    state->loop_count++;
+                    state->pos = *((uint16_t __far*) ptr); ptr += 2;
+                    state->bank += read_bank(ptr); ptr += VGMSWAN_BANK_BYTES;
+                    set_rom0_bank(state->bank);
+                    ptr = MK_FP(0x2000, state->pos);
+                } else {
+                    ptr += 2 + VGMSWAN_BANK_BYTES;
+                }
+            } break;
+            case 0xEC: { // set song volume attenuation
+                uint8_t attenuation = *(ptr++);
+                if (!is_sfx) {
+                    song_attenuation = attenuation;
+                    song_refresh_volume();
+                }
+            } break;
+            case 0xED: { // end of stream
+                ptr--;
+                result = VGMSWAN_PLAYBACK_FINISHED;
+            } break;
             case 0xEF: {
                 uint16_t new_pos = *((uint16_t __far*) ptr); ptr += 2;
                 state->pos = (uint16_t) ptr;
@@ -84,7 +320,7 @@ uint16_t vgmswan_play(vgmswan_state_t *state) {
                 result = cmd - 0xEF;
             } break;
             case 0xF7: {
-                outportb(IO_BANK_ROM0, ++state->bank);
+                set_rom0_bank(++state->bank);
                 state->pos = 0;
                 ptr = MK_FP(0x2000, 0);
             } break;
@@ -96,12 +332,16 @@ uint16_t vgmswan_play(vgmswan_state_t *state) {
             } break;
             case 0xFA: {
                 state->pos = *((uint16_t __far*) ptr); ptr += 2;
-                state->bank += *(ptr++);
-                outportb(IO_BANK_ROM0, state->bank);
+                state->bank += read_bank(ptr); ptr += VGMSWAN_BANK_BYTES;
+                set_rom0_bank(state->bank);
                 ptr = MK_FP(0x2000, state->pos);
             } break;
             case 0xFB: {
                 uint8_t ctrl = *(ptr++);
+                if (!is_sfx && (song_mask & 0x02)) {
+                    if (ctrl & 0x80) ptr += 4;
+                    break;
+                }
                 outportb(IO_SDMA_CTRL, 0);
                 if (ctrl & 0x80) {
                     // play sample
@@ -117,8 +357,17 @@ uint16_t vgmswan_play(vgmswan_state_t *state) {
             case 0xFE:
             case 0xFF: {
                 uint16_t addr = ((cmd - 0xFC) << 4) | addrPrefix;
+#ifdef VGMSWAN_GLOBAL_WAVETABLES
+                // sound effects cache wavetables in their current bank
+                uint8_t __far* mem_ptr = MK_FP(is_sfx ? 0x2000 : 0x3000, *((uint16_t __far*) ptr)); ptr += 2;
+#else
                 uint8_t __far* mem_ptr = MK_FP(0x2000, *((uint16_t __far*) ptr)); ptr += 2;
-                memcpy((uint8_t*) addr, mem_ptr, 16);
+#endif
+                if (is_sfx) {
+                    memcpy((uint8_t*) addr, mem_ptr, 16);
+                } else {
+                    song_wave_write(addrPrefix, (cmd - 0xFC) << 4, mem_ptr, 16);
+                }
             } break;
             }
         }
@@ -126,6 +375,51 @@ uint16_t vgmswan_play(vgmswan_state_t *state) {
     }
 
     if (restorePtr) state->pos = (uint16_t) ptr;
-    outportb(IO_BANK_ROM0, bank_backup);
+    set_rom0_bank(bank_backup);
     return result;
 }
+
+bool vgmswan_sfx_play(vgmswan_bank_t bank, uint8_t sfx_id) {
+    vgmswan_bank_t bank_backup = get_rom1_bank();
+    set_rom1_bank(bank);
+    uint8_t __far* ptr = MK_FP(0x3000, ((uint16_t) sfx_id) * (3 + VGMSWAN_BANK_BYTES));
+    uint8_t info = ptr[2 + VGMSWAN_BANK_BYTES];
+    uint8_t priority = info >> 4;
+
+    if (sfx_active && priority < sfx_priority) {
+        set_rom1_bank(bank_backup);
+        return false;
+    }
+    vgmswan_sfx_stop();
+
+    sfx_state.pos = ptr[0] | (ptr[1] << 8);
+    sfx_state.bank = bank + read_bank(ptr + 2);
+    sfx_state.flags = VGMSWAN_FLAG_SFX;
+    sfx_priority = priority;
+    sfx_active = true;
+    song_mask = info & 0x0F;
+    if (song_mask & 0x02) {
+        outportb(IO_SDMA_CTRL, 0);
+    }
+
+    set_rom1_bank(bank_backup);
+    return true;
+}
+
+uint16_t vgmswan_sfx_update(void) {
+    if (!sfx_active) return VGMSWAN_PLAYBACK_FINISHED;
+    uint16_t result = vgmswan_play(&sfx_state);
+    if (result == VGMSWAN_PLAYBACK_FINISHED) {
+        vgmswan_sfx_stop();
+    }
+    return result;
+}
+
+void vgmswan_sfx_stop(void) {
+    if (sfx_active) {
+        uint8_t channels = song_mask;
+        sfx_active = false;
+        song_mask = 0;
+        song_restore(channels);
+    }
+}
@@ -23,16 +23,55 @@
  */
 
 #pragma once
+#include <stdbool.h>
 #include <stdint.h>
 
+// define VGMSWAN_MAPPER_2003 to use 16-bit bank numbers, for ROMs with more
+// than 256 banks; the converter's -mapper-2003 option must match
+#ifdef VGMSWAN_MAPPER_2003
+typedef uint16_t vgmswan_bank_t;
+#define VGMSWAN_BANK_BYTES 2
+#else
+typedef uint8_t vgmswan_bank_t;
+#define VGMSWAN_BANK_BYTES 1
+#endif
+
+// define VGMSWAN_GLOBAL_WAVETABLES to read cached wavetables (0xFC-0xFF) from
+// the first bank, mapped to ROM1 as for samples, rather than from the song's
+// current bank; the converter's -global-wavetables option must match. Sound
+// effects keep reading them from their current bank.
+
 typedef struct {
     uint16_t pos;
-    uint8_t bank;
+    vgmswan_bank_t bank;
     uint8_t flags;
+    uint8_t loop_count;
+    uint8_t marker;
 } vgmswan_state_t;
 
+// called from vgmswan_play when a marker is reached
+typedef void (*vgmswan_marker_handler_t)(vgmswan_state_t *state, uint8_t marker);
+
+#define VGMSWAN_FLAG_SFX 0x01
+// set when a marker is reached; state->marker holds its ID, clear to acknowledge
+#define VGMSWAN_FLAG_MARKER 0x02
+
 #define VGMSWAN_PLAYBACK_FINISHED 0xFFFF
 
-void vgmswan_init(vgmswan_state_t *state, uint8_t bank, uint8_t song_id);
+void vgmswan_init(vgmswan_state_t *state, vgmswan_bank_t bank, uint8_t song_id);
 // return: amount of HBLANK lines to wait
 uint16_t vgmswan_play(vgmswan_state_t *state);
+void vgmswan_set_marker_handler(vgmswan_marker_handler_t handler);
+// attenuate all channel volumes by 0 (none) to 15 (silence) steps
+void vgmswan_set_master_attenuation(uint8_t attenuation);
+// play entry sample_id from the sample table at table_pos in the given bank
+void vgmswan_sample_play(vgmswan_bank_t bank, uint16_t table_pos, uint8_t sample_id);
+void vgmswan_sample_stop(void);
+
+// play sound effect sfx_id from the sound effect bank, muting the song's
+// writes to its channels; return: false if a higher priority effect is playing
+bool vgmswan_sfx_play(vgmswan_bank_t bank, uint8_t sfx_id);
+// return: amount of HBLANK lines to wait, as vgmswan_play
+uint16_t vgmswan_sfx_update(void);
+// stop the current sound effect, restoring the song's channel state
+void vgmswan_sfx_stop(void);